@@ -0,0 +1,34 @@
+// Package atomicfile replaces files without ever leaving them half written
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes `contents` to a temporary file next to `path` and renames it over `path`, so a crash or a reader
+// never sees a partial write. The temporary file is hidden and removed if anything goes wrong. Like ioutil.WriteFile,
+// the file ends up with permissions `perm`.
+func WriteFile(path string, contents []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates files as 0600
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,50 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, contents := range []string{`{"first": true}`, `{}`} {
+		if err := WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != contents {
+			t.Errorf("file contains %s, want %s", got, contents)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("file mode = %v, want 0644", info.Mode().Perm())
+	}
+
+	// nothing is left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("directory has %d files, want only the one written", len(files))
+	}
+}
+
+func TestWriteFileMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+	if err := WriteFile(path, []byte("{}"), 0644); err == nil {
+		t.Error("WriteFile() in a missing directory succeeded")
+	}
+}
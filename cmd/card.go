@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/streamer"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	defaultCardSeconds    = 5
+	defaultCardBackground = "black"
+	defaultCardTemplate   = "Up next\n{{.Title}}{{if .DurationSeconds}}\n{{.Duration}}{{end}}"
+)
+
+// cardData is what the card template is given: the next video's details, plus the channel name
+type cardData struct {
+	videostorage.Video
+
+	Channel string
+}
+
+// cardFormatter builds the "up next" card shown before each video
+type cardFormatter struct {
+	template *template.Template
+	channel  string
+	card     streamer.Card
+}
+
+// newCardFormatter reads the `up_next_card` section of the config. `up_next_card.template` is a Go template that is
+// given the next video's details and `{{.Channel}}`. Returns nil unless cards are enabled.
+func newCardFormatter() *cardFormatter {
+	if !viper.GetBool("up_next_card.enabled") {
+		return nil
+	}
+
+	text := viper.GetString("up_next_card.template")
+	if text == "" {
+		text = defaultCardTemplate
+	}
+	tmpl, err := template.New("card").Parse(text)
+	if err != nil {
+		log.WithError(err).Fatal("could not parse up_next_card.template")
+	}
+
+	seconds := viper.GetFloat64("up_next_card.duration_seconds")
+	if seconds <= 0 {
+		seconds = defaultCardSeconds
+	}
+	background := viper.GetString("up_next_card.background")
+	if background == "" {
+		background = defaultCardBackground
+	}
+
+	return &cardFormatter{
+		template: tmpl,
+		channel:  viper.GetString("up_next_card.channel"),
+		card: streamer.Card{
+			Branding:   viper.GetString("up_next_card.branding"),
+			Duration:   time.Duration(seconds * float64(time.Second)),
+			Background: background,
+			FontFile:   viper.GetString("up_next_card.font_file"),
+		},
+	}
+}
+
+// Card renders the card for `key`. Returns false if the template fails.
+func (f *cardFormatter) Card(storage videostorage.Storage, key string) (streamer.Card, bool) {
+	video, ok := storage.GetVideoInfo(key)
+	if !ok {
+		video = videostorage.Video{Key: key, Title: videostorage.Title(key)}
+	}
+
+	var res strings.Builder
+	if err := f.template.Execute(&res, cardData{video, f.channel}); err != nil {
+		log.WithError(err).WithField("video", key).Warn("could not render up next card")
+		return streamer.Card{}, false
+	}
+
+	card := f.card
+	card.Text = strings.TrimSpace(res.String())
+	return card, true
+}
+
+// play streams the card for `key`. Nothing is played if `key` is empty.
+func (f *cardFormatter) play(strm *streamer.Streamer, storage videostorage.Storage, key string) {
+	if key == "" {
+		return
+	}
+
+	card, ok := f.Card(storage, key)
+	if !ok {
+		return
+	}
+
+	err := strm.StartCard(card)
+	if err != nil && !errors.Is(err, streamer.ErrSkipped) && !errors.Is(err, streamer.ErrStopped) {
+		log.WithError(err).WithField("video", key).Warn("up next card failed")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/schedule"
+	"github.com/lthummus/bucket-stream/server"
+	"github.com/lthummus/bucket-stream/streamer"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	defaultIdentFolder  = "idents/"
+	defaultBumperFolder = "bumpers/"
+)
+
+// interstitialRules decides which clips from the interstitial pool play between videos
+type interstitialRules struct {
+	pool *videostorage.Interstitials
+
+	// IdentEvery plays an ident after every this many videos. Zero turns idents off.
+	IdentEvery   int
+	IdentFolder  string
+	Bumpers      bool
+	BumperFolder string
+}
+
+// interstitialsFromConfig reads the `interstitials` section of the config. Returns nil if there is no interstitial
+// pool.
+func interstitialsFromConfig(sources []videostorage.Source) *interstitialRules {
+	pool := videostorage.InterstitialsFromConfig(sources)
+	if pool == nil {
+		return nil
+	}
+
+	rules := &interstitialRules{
+		pool:         pool,
+		IdentEvery:   viper.GetInt("interstitials.ident_every"),
+		IdentFolder:  viper.GetString("interstitials.ident_folder"),
+		Bumpers:      viper.GetBool("interstitials.bumpers"),
+		BumperFolder: viper.GetString("interstitials.bumper_folder"),
+	}
+	if rules.IdentFolder == "" {
+		rules.IdentFolder = defaultIdentFolder
+	}
+	if rules.BumperFolder == "" {
+		rules.BumperFolder = defaultBumperFolder
+	}
+
+	log.WithFields(log.Fields{
+		"source":      pool.Source.String(),
+		"ident_every": rules.IdentEvery,
+		"bumpers":     rules.Bumpers,
+	}).Info("interstitials enabled")
+
+	return rules
+}
+
+// clips lists what should play after the `playIndex`th video: any scheduled break that is due, then an ident if one
+// is due, then a bumper leading in to the next video. Folders with nothing in them are skipped.
+func (r *interstitialRules) clips(sched *schedule.Schedule, playIndex int, now time.Time) []string {
+	var res []string
+	add := func(folder string) {
+		if key, ok := r.pool.Random(folder); ok {
+			res = append(res, key)
+		} else {
+			log.WithField("folder", folder).Warn("no interstitials to play in folder")
+		}
+	}
+
+	if sched != nil {
+		if brk := sched.TakeBreak(now); brk != nil {
+			log.WithFields(log.Fields{
+				"folder": brk.Folder,
+				"count":  brk.Count,
+			}).Info("starting scheduled break")
+			for i := 0; i < brk.Count; i++ {
+				add(brk.Folder)
+			}
+		}
+	}
+	if r.IdentEvery > 0 && playIndex%r.IdentEvery == 0 {
+		add(r.IdentFolder)
+	}
+	if r.Bumpers {
+		add(r.BumperFolder)
+	}
+
+	return res
+}
+
+// play streams the interstitials due after the `playIndex`th video, giving up if the stream is paused or stopping or
+// an airing is due. A clip that fails is logged and passed over.
+func (r *interstitialRules) play(strm *streamer.Streamer, srv *server.Server, sched *schedule.Schedule, playIndex int) {
+	for _, key := range r.clips(sched, playIndex, time.Now()) {
+		if srv.IsPaused() || !srv.ShouldContinue() || airingDue(sched) {
+			return
+		}
+
+		input, err := r.pool.Open(key)
+		if err != nil {
+			log.WithError(err).WithField("interstitial", key).Warn("could not open interstitial")
+			continue
+		}
+
+		err = strm.StartInterstitial(key, input)
+		if err != nil && !errors.Is(err, streamer.ErrSkipped) && !errors.Is(err, streamer.ErrStopped) {
+			log.WithError(err).WithField("interstitial", key).Warn("interstitial failed")
+		}
+	}
+}
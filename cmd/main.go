@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
-	"path"
-	"strings"
 	"time"
 
 	"github.com/lthummus/bucket-stream/config"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"github.com/lthummus/bucket-stream/eventbus"
 	"github.com/lthummus/bucket-stream/notifier"
+	"github.com/lthummus/bucket-stream/picker"
+	"github.com/lthummus/bucket-stream/queue"
+	"github.com/lthummus/bucket-stream/schedule"
 	"github.com/lthummus/bucket-stream/server"
 	"github.com/lthummus/bucket-stream/streamer"
 	"github.com/lthummus/bucket-stream/twitch"
@@ -42,6 +46,8 @@ func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
 	})
+	logTail := server.NewLogTail(500)
+	log.AddHook(logTail)
 	log.Info("hello world!")
 	rand.Seed(time.Now().Unix())
 
@@ -54,6 +60,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(handleValidate())
+	}
+
 	// get the ffmpeg path
 	ffmpegPath := viper.GetString("ffmpeg.path")
 	if ffmpegPath == "" {
@@ -66,11 +76,8 @@ func main() {
 	// initialize the twitch API
 	twitchApi.GetUserInfo()
 
-	// read the source bucket
-	bucketName := viper.GetString("s3.bucket")
-	if bucketName == "" {
-		log.Fatal("environment variable VIDEO_BUCKET_NAME is empty")
-	}
+	// read the video sources
+	sources := videostorage.SourcesFromConfig()
 
 	// read the twitch endpoint URL (which includes the stream key -- see README for more details)
 	twitchEndpoint := viper.GetString("twitch.endpoint")
@@ -83,63 +90,242 @@ func main() {
 	} else {
 		log.Info("using twitch.endpoint from config")
 	}
+	// the stream key must never show up in the log tail, which any read key can see
+	logTail.Redact(twitchEndpoint, streamer.StreamKey(twitchEndpoint))
 
 	// initialize video storage
-	storage := videostorage.New(bucketName)
-	log.WithField("bucket", bucketName).Info("video storage initialized")
+	var pick videostorage.Picker = picker.FromConfig(rand.New(rand.NewSource(time.Now().UnixNano())))
+	if series := picker.SeriesFromConfig(pick); series != nil {
+		pick = series
+	}
+	bucketStorage := videostorage.New(sources, pick)
+	log.WithField("sources", len(sources)).Info("video storage initialized")
 
-	notifierURLs := viper.GetStringSlice("notification_urls")
+	var storage videostorage.Storage = bucketStorage
+	if cache := videostorage.DiskCacheFromConfig(bucketStorage); cache != nil {
+		storage = cache
+	}
 
-	var notifiers []notifier.Notifier
-	for _, curr := range notifierURLs {
-		notifiers = append(notifiers, &notifier.Webhook{
-			Url: curr,
-		})
+	deadLetterFile := viper.GetString("webhook.dead_letter_file")
+	if deadLetterFile == "" {
+		deadLetterFile = "webhook-dead-letters.jsonl"
 	}
+	deadLetters := notifier.NewDeadLetterLog(deadLetterFile)
+
+	// everything publishes to the event bus, and the notifiers hear about everything except progress ticks
+	events := eventbus.New()
+	notifiers := notifier.FromConfig(deadLetters)
+	notifiersDone := events.Forward(notifiers, notifier.EventProgress)
+	bucketStorage.SetNotifier(events)
+	bucketStorage.WatchEventQueue()
+
+	playQueue := &queue.Queue{}
+	sched := schedule.FromConfig()
+	interstitials := interstitialsFromConfig(sources)
 
 	// start streamer
 	strm := streamer.Streamer{
 		FfmpegPath:     ffmpegPath,
 		TwitchEndpoint: twitchEndpoint,
+		Events:         events,
 	}
 
 	// start server
 	srv := server.Server{
-		Storage:  storage,
-		Streamer: &strm,
+		Storage:     storage,
+		Streamer:    &strm,
+		DeadLetters: deadLetters,
+		Events:      events,
+		Queue:       playQueue,
+		Schedule:    sched,
+		Logs:        logTail,
 	}
 	go srv.StartServer()
 
+	shutdown := newShutdownHandler(&srv, &strm, events)
+	go shutdown.listen()
+
+	events.Publish(notifier.Event{
+		Type:       notifier.EventStreamUp,
+		VideoCount: storage.GetVideoCount(),
+	})
+
+	slate := streamer.SlateFromConfig()
+	titles := newTitleFormatter()
+	cards := newCardFormatter()
+
 	// main loop of the app
+	playIndex := 0
+	prefetchBytes := prefetchSize()
+	var next *upNext
 	for {
-		// pick a video
+		// while paused, keep the channel live with the standby slate. resuming ends the slate.
+		if srv.IsPaused() {
+			if next != nil {
+				next.Discard()
+				next = nil
+				srv.SetUpNext("")
+			}
+
+			log.Info("paused, streaming standby slate")
+			if err := strm.StartSlate(slate); err != nil && !errors.Is(err, streamer.ErrSkipped) && !errors.Is(err, streamer.ErrStopped) {
+				log.WithError(err).Warn("standby slate failed, waiting before trying again")
+				time.Sleep(5 * time.Second)
+			}
+
+			if !srv.ShouldContinue() {
+				log.Info("server says we should stop. so stopping")
+				break
+			}
+			continue
+		}
+
+		// pick a video, preferring anything an operator has queued up
 		log.Info("starting cycle")
-		pickedVideo, buf := storage.PickVideo()
-		log.WithFields(log.Fields{
-			"video": pickedVideo,
-		}).Info("winner picked")
+		pickedVideo, buf, err := nextVideo(storage, playQueue, sched, next)
+		next = nil
+		if err != nil {
+			// the library may be empty until the manifest or an enumeration fills it, or everything in it may be
+			// quarantined, so wait and try again
+			log.WithError(err).Warn("nothing to play, waiting before trying again")
+			time.Sleep(5 * time.Second)
+			if !srv.ShouldContinue() {
+				log.Info("server says we should stop. so stopping")
+				break
+			}
+			continue
+		}
+
+		// a shutdown may have been asked for while the video was being opened
+		if !srv.ShouldContinue() {
+			if err := buf.Close(); err != nil {
+				log.WithError(err).WithField("video", pickedVideo).Warn("error closing video input")
+			}
+			log.Info("server says we should stop. so stopping")
+			break
+		}
 
 		// update the stream title
-		streamTitle := strings.TrimPrefix(strings.TrimSuffix(path.Base(pickedVideo), path.Ext(pickedVideo)), "/")
-		go twitchApi.UpdateStreamTitle(streamTitle)
+		streamTitle := videostorage.Title(pickedVideo)
+		go twitchApi.UpdateStreamTitle(titles.Format(storage, pickedVideo))
+
+		playIndex++
+		videoStart := time.Now()
+		storage.RecordPlay(pickedVideo)
+		if sched != nil {
+			sched.Played(storage, pickedVideo, videoStart)
+		}
+		startEvent := notifier.Event{
+			Type:           notifier.EventVideoStarted,
+			VideoKey:       pickedVideo,
+			Title:          streamTitle,
+			PlayIndex:      playIndex,
+			VideoStartedAt: &videoStart,
+		}
 
-		for _, curr := range notifiers {
-			go curr.Notify(streamTitle)
+		// line up the next video and start downloading it while this one plays
+		if prefetchBytes > 0 {
+			expectedEnd := videoStart
+			if video, ok := storage.GetVideoInfo(pickedVideo); ok {
+				expectedEnd = videoStart.Add(video.Duration())
+			}
+			next = pickUpNext(storage, playQueue, sched, expectedEnd, prefetchBytes)
+		}
+		if next != nil {
+			startEvent.NextVideoKey = next.Key
+		} else if nextKey, ok := playQueue.Peek(); ok {
+			startEvent.NextVideoKey = nextKey
 		}
+		// the server works out for itself when the queue comes first, so it only needs to know about other picks
+		if next != nil && !next.fromQueue {
+			srv.SetUpNext(next.Key)
+		} else {
+			srv.SetUpNext("")
+		}
+		if startEvent.NextVideoKey != "" {
+			startEvent.NextTitle = videostorage.Title(startEvent.NextVideoKey)
+		}
+		events.Publish(startEvent)
+
+		// cut the video short if an airing that preempts is due before it would end
+		stopPreempt := preemptForAiring(sched, &strm, pickedVideo, videoStart)
 
 		// start streaming
 		log.WithFields(log.Fields{
 			"video": pickedVideo,
 		}).Info("opened stream")
-		strm.StartFfmpegStream(pickedVideo, buf)
+		err = strm.StartFfmpegStream(pickedVideo, buf)
+		stopPreempt()
 		log.WithFields(log.Fields{
 			"video": pickedVideo,
 		}).Info("cycle complete")
 
+		endEvent := notifier.Event{
+			Type:            notifier.EventVideoFinished,
+			VideoKey:        pickedVideo,
+			Title:           streamTitle,
+			PlayIndex:       playIndex,
+			VideoStartedAt:  &videoStart,
+			DurationSeconds: time.Since(videoStart).Seconds(),
+		}
+		if errors.Is(err, streamer.ErrSkipped) || errors.Is(err, streamer.ErrStopped) {
+			endEvent.Type = notifier.EventVideoSkipped
+		} else if err != nil {
+			endEvent.Type = notifier.EventVideoErrored
+			endEvent.Error = err.Error()
+		}
+		events.Publish(endEvent)
+
+		if err != nil && !errors.Is(err, streamer.ErrSkipped) && !errors.Is(err, streamer.ErrStopped) {
+			// don't spin if ffmpeg is failing on everything
+			log.WithError(err).Warn("ffmpeg failed, waiting before next video")
+			time.Sleep(5 * time.Second)
+		}
+
+		if !srv.ShouldContinue() {
+			log.Info("server says we should stop. so stopping")
+			break
+		}
+
+		// idents, bumpers and breaks go between videos, without counting as plays, and then the up next card if we know
+		// what is next. none of them may hold up an airing.
+		if (interstitials != nil || cards != nil) && !airingDue(sched) {
+			stopPreempt = preemptForAiring(sched, &strm, "interstitials", time.Now())
+			if interstitials != nil {
+				interstitials.play(&strm, &srv, sched, playIndex)
+			}
+			if cards != nil && !srv.IsPaused() && srv.ShouldContinue() && !airingDue(sched) {
+				cards.play(&strm, storage, upcomingKey(playQueue, sched, next))
+			}
+			stopPreempt()
+		}
 		if !srv.ShouldContinue() {
 			log.Info("server says we should stop. so stopping")
 			break
 		}
 	}
 
+	if next != nil {
+		next.Discard()
+	}
+
+	// clean up, giving up if it takes longer than the shutdown deadline
+	shutdown.startWatchdog()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown.deadline)
+	defer cancel()
+
+	events.Publish(notifier.Event{
+		Type:       notifier.EventProcessExit,
+		PlayIndex:  playIndex,
+		VideoCount: storage.GetVideoCount(),
+	})
+	events.Close()
+	<-notifiersDone
+	notifiers.Flush(ctx)
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("web server did not shut down cleanly")
+	}
+
+	log.Info("goodbye!")
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/eventbus"
+	"github.com/lthummus/bucket-stream/notifier"
+	"github.com/lthummus/bucket-stream/server"
+	"github.com/lthummus/bucket-stream/streamer"
+)
+
+const (
+	// shutdownModeFinish lets the current video play out before exiting, the same as `PUT /continue/no`
+	shutdownModeFinish = "finish"
+	// shutdownModeImmediate stops ffmpeg straight away and exits once everything is cleaned up
+	shutdownModeImmediate = "immediate"
+
+	defaultShutdownDeadline = 20 * time.Second
+)
+
+// shutdownHandler turns SIGTERM and SIGINT in to an orderly exit. The first signal starts a shutdown in the configured
+// mode, and a second signal always stops immediately. Once an immediate stop begins, the process has until the
+// deadline to clean up before it is forcibly exited.
+type shutdownHandler struct {
+	srv    *server.Server
+	strm   *streamer.Streamer
+	events *eventbus.Bus
+
+	mode           string
+	finishDeadline time.Duration
+	deadline       time.Duration
+
+	stopOnce     sync.Once
+	watchdogOnce sync.Once
+}
+
+func newShutdownHandler(srv *server.Server, strm *streamer.Streamer, events *eventbus.Bus) *shutdownHandler {
+	mode := viper.GetString("shutdown.mode")
+	if mode == "" {
+		mode = shutdownModeImmediate
+	}
+	if mode != shutdownModeFinish && mode != shutdownModeImmediate {
+		log.WithField("mode", mode).Fatal("shutdown.mode must be finish or immediate")
+	}
+
+	deadline := defaultShutdownDeadline
+	if configDeadline := viper.GetInt("shutdown.deadline_seconds"); configDeadline != 0 {
+		deadline = time.Duration(configDeadline) * time.Second
+	}
+
+	return &shutdownHandler{
+		srv:            srv,
+		strm:           strm,
+		events:         events,
+		mode:           mode,
+		finishDeadline: time.Duration(viper.GetInt("shutdown.finish_deadline_seconds")) * time.Second,
+		deadline:       deadline,
+	}
+}
+
+// listen waits for signals. It should be run in its own goroutine.
+func (h *shutdownHandler) listen() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	log.WithFields(log.Fields{
+		"signal": sig.String(),
+		"mode":   h.mode,
+	}).Info("received signal, shutting down")
+
+	h.srv.SetContinue(false)
+	h.events.Publish(notifier.Event{
+		Type: notifier.EventShutdownRequested,
+	})
+
+	if h.mode == shutdownModeImmediate {
+		h.stopNow()
+	} else if h.strm.InStandby() {
+		// there's no video to finish, just the standby slate, which would otherwise run forever
+		h.strm.Skip()
+	} else if h.finishDeadline > 0 {
+		time.AfterFunc(h.finishDeadline, func() {
+			log.WithField("finish_deadline", h.finishDeadline.String()).Warn("current video did not finish in time")
+			h.stopNow()
+		})
+	}
+
+	sig = <-signals
+	log.WithField("signal", sig.String()).Warn("received second signal, stopping immediately")
+	h.stopNow()
+}
+
+// stopNow stops the current video and starts the watchdog
+func (h *shutdownHandler) stopNow() {
+	h.stopOnce.Do(func() {
+		h.srv.SetContinue(false)
+		h.startWatchdog()
+		h.strm.Stop()
+	})
+}
+
+// startWatchdog exits the process if it is still running after the deadline
+func (h *shutdownHandler) startWatchdog() {
+	h.watchdogOnce.Do(func() {
+		time.AfterFunc(h.deadline, func() {
+			log.WithField("deadline", h.deadline.String()).Error("shutdown did not complete in time, exiting")
+			os.Exit(1)
+		})
+	})
+}
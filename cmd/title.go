@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+// titleFormatter builds the Twitch stream title for a video
+type titleFormatter struct {
+	template *template.Template
+}
+
+// newTitleFormatter reads `twitch.title_template`, a Go template that is given the video's details (including
+// anything found by probing). Without one, the stream title is just the video's title.
+func newTitleFormatter() titleFormatter {
+	text := viper.GetString("twitch.title_template")
+	if text == "" {
+		return titleFormatter{}
+	}
+
+	tmpl, err := template.New("title").Parse(text)
+	if err != nil {
+		log.WithError(err).Fatal("could not parse twitch.title_template")
+	}
+	return titleFormatter{template: tmpl}
+}
+
+// Format renders the title for `key`, falling back to the plain title if the template fails
+func (f titleFormatter) Format(storage videostorage.Storage, key string) string {
+	video, ok := storage.GetVideoInfo(key)
+	if !ok {
+		video = videostorage.Video{Key: key, Title: videostorage.Title(key)}
+	}
+	if f.template == nil {
+		return video.Title
+	}
+
+	var res strings.Builder
+	if err := f.template.Execute(&res, video); err != nil {
+		log.WithError(err).WithField("video", key).Warn("could not render stream title")
+		return video.Title
+	}
+	return strings.TrimSpace(res.String())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/queue"
+	"github.com/lthummus/bucket-stream/schedule"
+	"github.com/lthummus/bucket-stream/streamer"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const defaultPrefetchMegabytes = 16
+
+// upNext is the video lined up to play after the current one, already being prefetched
+type upNext struct {
+	*videostorage.Prefetched
+
+	fromQueue bool
+	// block is the schedule block the video was picked for, if any
+	block *schedule.Occurrence
+}
+
+// prefetchSize reads `prefetch.megabytes`, returning zero if prefetching is turned off
+func prefetchSize() int64 {
+	if viper.IsSet("prefetch.enabled") && !viper.GetBool("prefetch.enabled") {
+		return 0
+	}
+
+	megabytes := viper.GetInt64("prefetch.megabytes")
+	if megabytes == 0 {
+		megabytes = defaultPrefetchMegabytes
+	}
+	return megabytes * 1024 * 1024
+}
+
+// pickUpNext decides what should play after the current video, which is expected to end at `at`, and starts
+// prefetching it. The head of the queue is always next; otherwise the schedule or a random pick decides. Returns nil
+// if nothing could be picked.
+func pickUpNext(storage videostorage.Storage, playQueue *queue.Queue, sched *schedule.Schedule, at time.Time, size int64) *upNext {
+	if key, ok := playQueue.Peek(); ok {
+		return &upNext{videostorage.Prefetch(storage, key, size), true, nil}
+	}
+
+	var block *schedule.Occurrence
+	if sched != nil {
+		block = sched.Current(at)
+		if key, ok := sched.Peek(storage, at); ok {
+			return &upNext{videostorage.Prefetch(storage, key, size), false, block}
+		}
+	}
+
+	if video, ok := storage.ChooseVideo(func(videostorage.Video) bool { return true }); ok {
+		return &upNext{videostorage.Prefetch(storage, video.Key, size), false, block}
+	}
+	return nil
+}
+
+// stillCurrent reports whether the schedule block `next` was picked for is the one airing now. The pick is made
+// before the current video ends, so by the time it comes to play the schedule may have moved on.
+func (next *upNext) stillCurrent(sched *schedule.Schedule) bool {
+	if sched == nil {
+		return true
+	}
+
+	current := sched.Current(time.Now())
+	if current == nil || next.block == nil {
+		return current == nil && next.block == nil
+	}
+	return current.Block == next.block.Block && current.Start.Equal(next.block.Start)
+}
+
+// nextVideo plays any scheduled airing that is due, and otherwise pops videos off the queue until one opens
+// successfully. If the queue is empty, the programming schedule (if there is one) picks the video, and failing that a
+// random video is picked. If `next` is still what should play, and the schedule block it was picked for is still
+// airing, its prefetched reader is used; otherwise it is thrown away. Returns an error only if nothing could be opened
+// at all.
+func nextVideo(storage videostorage.Storage, playQueue *queue.Queue, sched *schedule.Schedule, next *upNext) (string, io.ReadCloser, error) {
+	// takeNext returns the prefetched reader if `key` is what was prefetched, and discards the prefetch either way
+	takeNext := func(key string, fromQueue bool) io.ReadCloser {
+		if next == nil {
+			return nil
+		}
+		prefetched := next
+		next = nil
+
+		if prefetched.Key != key || prefetched.fromQueue != fromQueue {
+			prefetched.Discard()
+			return nil
+		}
+
+		buf, err := prefetched.Open()
+		if err != nil {
+			log.WithError(err).WithField("video", key).Warn("prefetch failed, opening video directly")
+			return nil
+		}
+		return buf
+	}
+	defer takeNext("", false)
+
+	if sched != nil {
+		if airing := sched.DueAiring(time.Now()); airing != nil {
+			// mark it even if it fails to open so a broken airing doesn't get retried every cycle
+			sched.MarkAired(airing)
+
+			logger := log.WithFields(log.Fields{
+				"video":     airing.Key,
+				"scheduled": airing.Start,
+			})
+			buf, err := storage.OpenVideo(airing.Key)
+			if err == nil {
+				logger.Info("playing scheduled airing")
+				return airing.Key, buf, nil
+			}
+			logger.WithError(err).Error("could not open scheduled airing, skipping it")
+		}
+	}
+
+	for {
+		key, ok := playQueue.Pop()
+		if !ok {
+			break
+		}
+
+		if buf := takeNext(key, true); buf != nil {
+			log.WithField("video", key).Info("playing prefetched queued video")
+			return key, buf, nil
+		}
+
+		buf, err := storage.OpenVideo(key)
+		if err != nil {
+			log.WithError(err).WithField("video", key).Warn("could not open queued video, skipping it")
+			continue
+		}
+
+		log.WithField("video", key).Info("playing queued video")
+		return key, buf, nil
+	}
+
+	if next != nil && !next.fromQueue && !next.stillCurrent(sched) {
+		log.WithField("video", next.Key).Info("schedule moved on since up next was picked, picking again")
+		takeNext("", false)
+	}
+
+	if next != nil && !next.fromQueue {
+		key := next.Key
+		if buf := takeNext(key, false); buf != nil {
+			log.WithField("video", key).Info("playing prefetched video")
+			return key, buf, nil
+		}
+
+		buf, err := storage.OpenVideo(key)
+		if err == nil {
+			return key, buf, nil
+		}
+		log.WithError(err).WithField("video", key).Warn("could not open up next video, picking another")
+	}
+
+	if sched != nil {
+		if key, ok := sched.Peek(storage, time.Now()); ok {
+			buf, err := storage.OpenVideo(key)
+			if err == nil {
+				return key, buf, nil
+			}
+			log.WithError(err).WithField("video", key).Warn("could not open scheduled video, picking at random")
+		}
+	}
+
+	pickedVideo, buf, err := storage.PickVideo()
+	if err != nil {
+		return "", nil, err
+	}
+	log.WithFields(log.Fields{
+		"video": pickedVideo,
+	}).Info("winner picked")
+
+	return pickedVideo, buf, nil
+}
+
+// upcomingKey returns the video nextVideo is going to play, if that is known yet: a due airing, then the head of the
+// queue, then the prefetched pick if its schedule block is still airing. Returns an empty string otherwise.
+func upcomingKey(playQueue *queue.Queue, sched *schedule.Schedule, next *upNext) string {
+	if sched != nil {
+		if airing := sched.DueAiring(time.Now()); airing != nil {
+			return airing.Key
+		}
+	}
+	if key, ok := playQueue.Peek(); ok {
+		return key
+	}
+	if next != nil && !next.fromQueue && next.stillCurrent(sched) {
+		return next.Key
+	}
+	return ""
+}
+
+// airingDue reports whether a scheduled airing is waiting to play
+func airingDue(sched *schedule.Schedule) bool {
+	return sched != nil && sched.DueAiring(time.Now()) != nil
+}
+
+// preemptForAiring skips whatever is streaming when the next airing that preempts starts. `playing` is only used for
+// logging. The returned function cancels it, and must be called once whatever was playing has finished.
+func preemptForAiring(sched *schedule.Schedule, strm *streamer.Streamer, playing string, from time.Time) func() {
+	if sched == nil {
+		return func() {}
+	}
+
+	airing := sched.NextAiring(from, true)
+	if airing == nil {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(airing.Start.Sub(from), func() {
+		log.WithFields(log.Fields{
+			"video":  playing,
+			"airing": airing.Key,
+		}).Info("preempting for scheduled airing")
+		strm.Skip()
+	})
+	return func() {
+		timer.Stop()
+	}
+}
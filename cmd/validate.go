@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lthummus/bucket-stream/picker"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+// handleValidate checks every video in the library against the ingest requirements and prints whatever fails. Returns
+// the exit code: 0 if everything passed, 1 if anything failed.
+func handleValidate() int {
+	sources := videostorage.SourcesFromConfig()
+	if videostorage.ProberFromConfig() == nil {
+		log.Fatal("validation needs ffprobe")
+	}
+
+	// nothing is picked while validating, so the picker doesn't matter
+	storage := videostorage.New(sources, &picker.Weighted{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))})
+	invalid := storage.Validate()
+
+	for _, curr := range invalid {
+		fmt.Printf("%s\n", curr.Key)
+		for _, problem := range curr.Problems {
+			fmt.Printf("    %s\n", problem)
+		}
+	}
+	fmt.Printf("\n%d of %d videos failed validation\n", len(invalid), storage.GetVideoCount())
+
+	if len(invalid) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package eventbus
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lthummus/bucket-stream/notifier"
+)
+
+// Bus is an in-process pub/sub hub for stream events. The streamer, video storage, server and main loop all publish
+// to it, and anything interested (notifiers, SSE clients) subscribes. Publishing never blocks. A subscriber from
+// Subscribe that falls too far behind misses events rather than holding everyone else up, while notifiers attached
+// with Forward have events queued up for them without limit, so they never miss any.
+type Bus struct {
+	sync.Mutex
+
+	subscribers map[int]*subscriber
+	nextId      int
+	closed      bool
+}
+
+// subscriber is either lossy, with events sent straight to a buffered channel and dropped if it is full, or lossless,
+// with events queued in `pending` and `wake` poked whenever there are more
+type subscriber struct {
+	ch   chan notifier.Event
+	skip map[notifier.EventType]bool
+
+	lossless bool
+	pending  []notifier.Event
+	wake     chan struct{}
+}
+
+var _ notifier.Notifier = &Bus{}
+
+func New() *Bus {
+	return &Bus{
+		subscribers: make(map[int]*subscriber),
+	}
+}
+
+// Publish sends the event to every subscriber, stamping it with the current time if it doesn't already have one
+func (b *Bus) Publish(event notifier.Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	for id, sub := range b.subscribers {
+		if sub.skip[event.Type] {
+			continue
+		}
+
+		if sub.lossless {
+			sub.pending = append(sub.pending, event)
+			select {
+			case sub.wake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			log.WithFields(log.Fields{
+				"subscriber": id,
+				"event":      event.Type,
+			}).Debug("event bus subscriber is full, dropping event")
+		}
+	}
+}
+
+// Notify lets the bus be used anywhere a notifier is expected
+func (b *Bus) Notify(event notifier.Event) {
+	b.Publish(event)
+}
+
+// Subscribe returns a channel that receives every event published from now on, along with a function to unsubscribe.
+// `buffer` is how many events may pile up before new ones are dropped for this subscriber.
+func (b *Bus) Subscribe(buffer int) (<-chan notifier.Event, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	ch := make(chan notifier.Event, buffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	id := b.add(&subscriber{ch: ch})
+
+	return ch, func() {
+		b.Lock()
+		defer b.Unlock()
+
+		if sub, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(sub.ch)
+		}
+	}
+}
+
+// add registers a subscriber, returning its id. Must be called with the lock held.
+func (b *Bus) add(sub *subscriber) int {
+	id := b.nextId
+	b.nextId++
+	b.subscribers[id] = sub
+	return id
+}
+
+// Close stops the bus. Every subscriber's channel is closed once it has drained, and later publishes are dropped.
+func (b *Bus) Close() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	for id, sub := range b.subscribers {
+		delete(b.subscribers, id)
+		if sub.lossless {
+			close(sub.wake)
+		} else {
+			close(sub.ch)
+		}
+	}
+}
+
+// Forward subscribes `n` to the bus, passing along every event except those of the given types. Events are never
+// dropped: if `n` is slow, they queue up until it catches up. Skipped types are filtered out before they are queued.
+// The returned channel is closed once the bus has been closed and every event has been handed to `n`.
+func (b *Bus) Forward(n notifier.Notifier, skip ...notifier.EventType) <-chan struct{} {
+	sub := &subscriber{
+		skip:     make(map[notifier.EventType]bool),
+		lossless: true,
+		wake:     make(chan struct{}, 1),
+	}
+	for _, curr := range skip {
+		sub.skip[curr] = true
+	}
+
+	b.Lock()
+	if b.closed {
+		close(sub.wake)
+	} else {
+		b.add(sub)
+	}
+	b.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, open := <-sub.wake
+
+			b.Lock()
+			batch := sub.pending
+			sub.pending = nil
+			b.Unlock()
+
+			for _, event := range batch {
+				n.Notify(event)
+			}
+			if !open {
+				return
+			}
+		}
+	}()
+
+	return done
+}
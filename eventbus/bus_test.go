@@ -0,0 +1,115 @@
+package eventbus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lthummus/bucket-stream/notifier"
+)
+
+// slowNotifier records every event it is given, taking a while over each of the first few
+type slowNotifier struct {
+	sync.Mutex
+
+	events []notifier.Event
+	delay  time.Duration
+}
+
+func (n *slowNotifier) Notify(event notifier.Event) {
+	n.Lock()
+	defer n.Unlock()
+
+	if len(n.events) < 5 {
+		time.Sleep(n.delay)
+	}
+	n.events = append(n.events, event)
+}
+
+func TestForwardIsLossless(t *testing.T) {
+	bus := New()
+	n := &slowNotifier{delay: 20 * time.Millisecond}
+	done := bus.Forward(n, notifier.EventProgress)
+
+	// far more than any buffer, with progress ticks mixed in
+	for i := 0; i < 5000; i++ {
+		bus.Publish(notifier.Event{Type: notifier.EventProgress, PlayIndex: i})
+		bus.Publish(notifier.Event{Type: notifier.EventVideoStarted, PlayIndex: i})
+	}
+	bus.Publish(notifier.Event{Type: notifier.EventProcessExit})
+	bus.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarding didn't finish after the bus closed")
+	}
+
+	if len(n.events) != 5001 {
+		t.Fatalf("notifier got %d events, want 5001", len(n.events))
+	}
+	for i, curr := range n.events[:5000] {
+		if curr.Type != notifier.EventVideoStarted || curr.PlayIndex != i {
+			t.Fatalf("event %d is %s %d, want video_started %d in order", i, curr.Type, curr.PlayIndex, i)
+		}
+	}
+	if last := n.events[5000]; last.Type != notifier.EventProcessExit {
+		t.Errorf("last event is %s, want process_exit", last.Type)
+	}
+}
+
+func TestForwardAfterClose(t *testing.T) {
+	bus := New()
+	bus.Close()
+
+	select {
+	case <-bus.Forward(&slowNotifier{}):
+	case <-time.After(time.Second):
+		t.Fatal("forwarding to a closed bus didn't finish")
+	}
+}
+
+func TestSubscribeDropsWhenFull(t *testing.T) {
+	bus := New()
+	events, unsubscribe := bus.Subscribe(2)
+	defer unsubscribe()
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(notifier.Event{Type: notifier.EventVideoStarted, PlayIndex: i})
+	}
+
+	for i := 0; i < 2; i++ {
+		event := <-events
+		if event.PlayIndex != i {
+			t.Errorf("event %d has play index %d", i, event.PlayIndex)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("event %d wasn't given a timestamp", i)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("got %v, want the rest dropped", event)
+	default:
+	}
+}
+
+func TestCloseEndsSubscriptions(t *testing.T) {
+	bus := New()
+	events, _ := bus.Subscribe(10)
+	bus.Publish(notifier.Event{Type: notifier.EventVideoStarted})
+	bus.Close()
+	bus.Publish(notifier.Event{Type: notifier.EventVideoFinished})
+
+	if event, ok := <-events; !ok || event.Type != notifier.EventVideoStarted {
+		t.Fatalf("got %v %v, want the event published before closing", event, ok)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after the bus closed")
+	}
+
+	late, _ := bus.Subscribe(10)
+	if _, ok := <-late; ok {
+		t.Fatal("subscribing to a closed bus gave an open channel")
+	}
+}
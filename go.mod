@@ -1,11 +1,13 @@
 module github.com/lthummus/bucket-stream
 
-go 1.14
+go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.37.1
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/gin-gonic/gin v1.6.3
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/viper v1.10.1
 	github.com/toorop/gin-logrus v0.0.0-20200831135515-d2ee50d38dae
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,104 @@
+package notifier
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Config is a single entry in the `notifiers` config list. `Type` picks the implementation and `Events` optionally
+// restricts which events it receives. The remaining fields are specific to the type.
+type Config struct {
+	Type   string   `mapstructure:"type"`
+	Events []string `mapstructure:"events"`
+
+	// webhook
+	Url string `mapstructure:"url"`
+
+	// mqtt
+	Broker   string `mapstructure:"broker"`
+	Topic    string `mapstructure:"topic"`
+	Qos      int    `mapstructure:"qos"`
+	ClientId string `mapstructure:"client_id"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	// exec
+	Command        []string `mapstructure:"command"`
+	TimeoutSeconds int      `mapstructure:"timeout_seconds"`
+	Concurrency    int      `mapstructure:"concurrency"`
+	QueueSize      int      `mapstructure:"queue_size"`
+
+	// now_playing_file
+	TitleFile     string `mapstructure:"title_file"`
+	NextTitleFile string `mapstructure:"next_title_file"`
+	JsonFile      string `mapstructure:"json_file"`
+}
+
+// FromConfig builds every notifier described in the config. URLs in the legacy `notification_urls` list become
+// webhooks that only hear about video starts, which is all they ever received. Entries in `notifiers` are built by
+// type and wrapped in their event filters.
+func FromConfig(deadLetters *DeadLetterLog) Multi {
+	var notifiers Multi
+
+	for _, curr := range viper.GetStringSlice("notification_urls") {
+		notifiers = append(notifiers, NewFiltered(NewWebhook(curr, deadLetters), []string{string(EventVideoStarted)}))
+	}
+
+	var configs []Config
+	if err := viper.UnmarshalKey("notifiers", &configs); err != nil {
+		log.WithError(err).Fatal("could not read notifiers config")
+	}
+
+	for _, curr := range configs {
+		var n Notifier
+		switch curr.Type {
+		case "webhook":
+			if curr.Url == "" {
+				log.Fatal("webhook notifier is missing url")
+			}
+			n = NewWebhook(curr.Url, deadLetters)
+		case "mqtt":
+			if curr.Broker == "" {
+				log.Fatal("mqtt notifier is missing broker")
+			}
+			if curr.Qos < 0 || curr.Qos > 2 {
+				log.WithField("qos", curr.Qos).Fatal("mqtt qos must be 0, 1 or 2")
+			}
+			topic := curr.Topic
+			if topic == "" {
+				topic = "bucket-stream"
+			}
+			n = NewMqtt(curr.Broker, topic, byte(curr.Qos), curr.ClientId, curr.Username, curr.Password)
+		case "exec":
+			if len(curr.Command) == 0 {
+				log.Fatal("exec notifier is missing command")
+			}
+			timeoutSeconds := curr.TimeoutSeconds
+			if timeoutSeconds == 0 {
+				timeoutSeconds = 30
+			}
+			n = NewExec(curr.Command, time.Duration(timeoutSeconds)*time.Second, curr.Concurrency, curr.QueueSize)
+		case "now_playing_file":
+			if curr.TitleFile == "" && curr.NextTitleFile == "" && curr.JsonFile == "" {
+				log.Fatal("now_playing_file notifier needs at least one of title_file, next_title_file or json_file")
+			}
+			n = &NowPlayingFile{
+				TitlePath:     curr.TitleFile,
+				NextTitlePath: curr.NextTitleFile,
+				JsonPath:      curr.JsonFile,
+			}
+		default:
+			log.WithField("type", curr.Type).Fatal("unknown notifier type")
+		}
+
+		notifiers = append(notifiers, NewFiltered(n, curr.Events))
+		log.WithFields(log.Fields{
+			"type":   curr.Type,
+			"events": curr.Events,
+		}).Info("notifier configured")
+	}
+
+	return notifiers
+}
@@ -0,0 +1,144 @@
+package notifier
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lthummus/bucket-stream/atomicfile"
+)
+
+// DeadLetter is a webhook payload that could not be delivered.
+type DeadLetter struct {
+	Url      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// DeadLetterLog is an append-only file of undeliverable webhook payloads, one JSON object per line. Webhooks created
+// with a dead letter log register themselves with it so that entries can be replayed to the endpoint they came from.
+type DeadLetterLog struct {
+	sync.Mutex
+
+	path     string
+	webhooks map[string]*Webhook
+}
+
+// NewDeadLetterLog builds a dead letter log backed by the file at the given path. The file is created on first write.
+func NewDeadLetterLog(path string) *DeadLetterLog {
+	return &DeadLetterLog{
+		path:     path,
+		webhooks: make(map[string]*Webhook),
+	}
+}
+
+func (d *DeadLetterLog) register(w *Webhook) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.webhooks[w.Url] = w
+}
+
+// Write appends an entry to the log
+func (d *DeadLetterLog) Write(entry DeadLetter) error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.appendEntries([]DeadLetter{entry})
+}
+
+func (d *DeadLetterLog) appendEntries(entries []DeadLetter) error {
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for _, curr := range entries {
+		if err := encoder.Encode(&curr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay reads every entry in the log and re-queues it on the webhook it was originally destined for. Entries for
+// endpoints that are no longer configured, or whose queue is full, are kept in the log. Entries that fail again will
+// be written back to the log by the webhook's delivery worker. The log is only rewritten once the entries have been
+// handed off, so a failure part way through never loses any. Returns the number of entries re-queued.
+func (d *DeadLetterLog) Replay() (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	entries, err := d.readEntries()
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	// handing off never blocks or writes to this log, so it's safe under the lock. anything that fails from here on
+	// waits for the lock before it's written back, so it lands after the rewrite.
+	var kept []DeadLetter
+	replayed := 0
+	for _, curr := range entries {
+		if w, ok := d.webhooks[curr.Url]; ok && w.offer(curr.Payload) {
+			replayed++
+		} else {
+			kept = append(kept, curr)
+		}
+	}
+
+	var contents bytes.Buffer
+	encoder := json.NewEncoder(&contents)
+	for _, curr := range kept {
+		if err := encoder.Encode(&curr); err != nil {
+			return replayed, err
+		}
+	}
+	if err := atomicfile.WriteFile(d.path, contents.Bytes(), 0644); err != nil {
+		// the replayed entries are still in the log, so at worst they are delivered twice
+		return replayed, err
+	}
+
+	log.WithFields(log.Fields{
+		"replayed": replayed,
+		"kept":     len(kept),
+	}).Info("replayed webhook dead letters")
+
+	return replayed, nil
+}
+
+func (d *DeadLetterLog) readEntries() ([]DeadLetter, error) {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.WithError(err).Warn("skipping malformed dead letter entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,94 @@
+package notifier
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeDeadLetters(t *testing.T, d *DeadLetterLog, urls ...string) {
+	t.Helper()
+
+	for i, url := range urls {
+		payload, _ := json.Marshal(map[string]int{"entry": i})
+		if err := d.Write(DeadLetter{Url: url, Payload: payload, Error: "failed", Attempts: 1, FailedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	endpoint := &fakeEndpoint{statuses: []int{200}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+	w := testWebhook(server.URL, 3, 10, deadLetters, true)
+
+	writeDeadLetters(t, deadLetters, server.URL, "http://localhost/removed", server.URL)
+
+	replayed, err := deadLetters.Replay()
+	if err != nil || replayed != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2 replayed", replayed, err)
+	}
+	flushWebhook(t, w)
+
+	got := endpoint.received()
+	if len(got) != 2 || got[0] != `{"entry":0}` || got[1] != `{"entry":2}` {
+		t.Errorf("endpoint got %q, want entries 0 and 2 in order", got)
+	}
+
+	// the entry for an endpoint that isn't configured any more stays
+	entries := readDeadLetters(t, deadLetters)
+	if len(entries) != 1 || entries[0].Url != "http://localhost/removed" {
+		t.Errorf("log holds %+v after replay, want just the entry for the removed endpoint", entries)
+	}
+}
+
+func TestReplayKeepsWhatDoesNotFit(t *testing.T) {
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+	// nothing is taking from the queue, which only has room for one
+	w := testWebhook("http://localhost/hook", 3, 1, deadLetters, false)
+
+	writeDeadLetters(t, deadLetters, w.Url, w.Url, w.Url)
+
+	replayed, err := deadLetters.Replay()
+	if err != nil || replayed != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1 replayed", replayed, err)
+	}
+
+	entries := readDeadLetters(t, deadLetters)
+	if len(entries) != 2 || string(entries[0].Payload) != `{"entry":1}` || entries[0].Attempts != 1 {
+		t.Errorf("log holds %+v after replay, want entries 1 and 2 untouched", entries)
+	}
+}
+
+func TestReplayFailingAgainIsKept(t *testing.T) {
+	endpoint := &fakeEndpoint{statuses: []int{500}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+	w := testWebhook(server.URL, 2, 10, deadLetters, true)
+
+	writeDeadLetters(t, deadLetters, server.URL)
+
+	if replayed, err := deadLetters.Replay(); err != nil || replayed != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1 replayed", replayed, err)
+	}
+	flushWebhook(t, w)
+
+	// written back by the delivery worker after the log was rewritten, so there's exactly one copy
+	entries := readDeadLetters(t, deadLetters)
+	if len(entries) != 1 || string(entries[0].Payload) != `{"entry":0}` || entries[0].Attempts != 2 {
+		t.Errorf("log holds %+v, want the entry back once after failing twice more", entries)
+	}
+}
+
+func TestReplayEmptyLog(t *testing.T) {
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+
+	if replayed, err := deadLetters.Replay(); err != nil || replayed != 0 {
+		t.Errorf("Replay() = %d, %v, want nothing to do", replayed, err)
+	}
+}
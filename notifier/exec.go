@@ -0,0 +1,180 @@
+package notifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultExecQueueSize is how many events can wait for a command to be free before new ones are dropped
+const defaultExecQueueSize = 100
+
+// Exec runs a local command for every event. The event is written to the command's stdin as JSON and its fields are
+// also passed as `BUCKET_STREAM_*` environment variables. Each run is killed if it takes longer than `Timeout`, and at
+// most `Concurrency` runs happen at once. Events beyond that wait their turn in a queue, and if the queue is full
+// they are dropped, so a slow command can't pile up work without bound. Flushing stops the notifier, so events after
+// that are dropped too.
+type Exec struct {
+	Command []string
+	Timeout time.Duration
+
+	lock    sync.Mutex
+	closed  bool
+	queue   chan execJob
+	workers sync.WaitGroup
+}
+
+// execJob is an event waiting for its command to run
+type execJob struct {
+	event   Event
+	payload []byte
+}
+
+var _ Notifier = &Exec{}
+var _ Flusher = &Exec{}
+
+// NewExec builds an exec notifier and starts `concurrency` workers to run it. `command` is the program followed by its
+// arguments, and at most `queueSize` events wait for a free worker.
+func NewExec(command []string, timeout time.Duration, concurrency int, queueSize int) *Exec {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if queueSize < 1 {
+		queueSize = defaultExecQueueSize
+	}
+
+	e := &Exec{
+		Command: command,
+		Timeout: timeout,
+		queue:   make(chan execJob, queueSize),
+	}
+	e.workers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go e.worker()
+	}
+
+	return e
+}
+
+func (e *Exec) Notify(event Event) {
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		log.WithError(err).Warn("could not marshal exec payload")
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"command": e.Command[0],
+		"event":   event.Type,
+	})
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		logger.Warn("exec notifier already flushed, dropping event")
+		return
+	}
+
+	select {
+	case e.queue <- execJob{event: event, payload: payload}:
+	default:
+		logger.Warn("exec notifier queue full, dropping event")
+	}
+}
+
+func (e *Exec) worker() {
+	defer e.workers.Done()
+
+	for job := range e.queue {
+		e.run(job.event, job.payload)
+	}
+}
+
+func (e *Exec) run(event Event, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+
+	logger := log.WithFields(log.Fields{
+		"command": e.Command[0],
+		"event":   event.Type,
+	})
+
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), eventEnvironment(event)...)
+
+	output, err := cmd.CombinedOutput()
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			logger.Info(line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.WithField("timeout", e.Timeout.String()).Warn("exec notifier timed out")
+	} else if err != nil {
+		logger.WithError(err).Warn("exec notifier failed")
+	} else {
+		logger.Debug("exec notifier finished")
+	}
+}
+
+// eventEnvironment converts the event in to `KEY=value` pairs for the command's environment
+func eventEnvironment(event Event) []string {
+	env := []string{
+		fmt.Sprintf("BUCKET_STREAM_EVENT=%s", event.Type),
+		fmt.Sprintf("BUCKET_STREAM_TIMESTAMP=%s", event.Timestamp.Format(time.RFC3339)),
+		fmt.Sprintf("BUCKET_STREAM_VIDEO_KEY=%s", event.VideoKey),
+		fmt.Sprintf("BUCKET_STREAM_TITLE=%s", event.Title),
+		fmt.Sprintf("BUCKET_STREAM_PLAY_INDEX=%d", event.PlayIndex),
+		fmt.Sprintf("BUCKET_STREAM_DURATION_SECONDS=%s", strconv.FormatFloat(event.DurationSeconds, 'f', -1, 64)),
+		fmt.Sprintf("BUCKET_STREAM_VIDEO_COUNT=%d", event.VideoCount),
+		fmt.Sprintf("BUCKET_STREAM_ERROR=%s", event.Error),
+		fmt.Sprintf("BUCKET_STREAM_NEXT_VIDEO_KEY=%s", event.NextVideoKey),
+		fmt.Sprintf("BUCKET_STREAM_NEXT_TITLE=%s", event.NextTitle),
+		// one key per line, so a shell script can loop over it
+		fmt.Sprintf("BUCKET_STREAM_QUEUE=%s", strings.Join(event.Queue, "\n")),
+	}
+
+	if event.VideoStartedAt != nil {
+		env = append(env, fmt.Sprintf("BUCKET_STREAM_VIDEO_STARTED_AT=%s", event.VideoStartedAt.Format(time.RFC3339)))
+	}
+
+	return env
+}
+
+// Flush stops taking new events and waits for every queued and running command to finish. It is meant for shutdown:
+// anything notified afterwards is dropped.
+func (e *Exec) Flush(ctx context.Context) {
+	e.lock.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithField("command", e.Command[0]).Warn("gave up waiting for exec notifiers")
+	}
+}
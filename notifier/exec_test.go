@@ -0,0 +1,99 @@
+package notifier
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecDropsEventsWhenQueueIsFull(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "events")
+	// each run records its event and then holds its slot for a while
+	e := NewExec([]string{"sh", "-c", `echo "$BUCKET_STREAM_EVENT" >> "$0"; sleep 0.2`, out}, 5*time.Second, 1, 1)
+
+	for i := 0; i < 5; i++ {
+		e.Notify(Event{Type: EventVideoStarted})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.Flush(ctx)
+
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one run can start straight away and one more can wait, depending on how quickly the worker picks up the first
+	runs := strings.Count(string(contents), string(EventVideoStarted))
+	if runs < 1 || runs > 2 {
+		t.Errorf("command ran %d times, want 1 or 2 with the rest dropped", runs)
+	}
+}
+
+func TestExecPassesNextVideoAndQueue(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	e := NewExec([]string{"sh", "-c", `printf '%s|%s|%s' "$BUCKET_STREAM_NEXT_VIDEO_KEY" "$BUCKET_STREAM_NEXT_TITLE" "$BUCKET_STREAM_QUEUE" > "$0"`, out}, 5*time.Second, 1, 1)
+
+	e.Notify(Event{
+		Type:         EventQueueChanged,
+		NextVideoKey: "shows/a.flv",
+		NextTitle:    "a",
+		Queue:        []string{"shows/a.flv", "shows/b c.flv"},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.Flush(ctx)
+
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "shows/a.flv|a|shows/a.flv\nshows/b c.flv"; string(contents) != want {
+		t.Errorf("command saw %q, want %q", contents, want)
+	}
+}
+
+func TestExecNotifyDuringFlush(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "events")
+	e := NewExec([]string{"sh", "-c", `echo "$BUCKET_STREAM_EVENT" >> "$0"`, out}, 5*time.Second, 2, 100)
+
+	// events keep arriving while the notifier is flushed, and must neither panic nor be run after Flush returns
+	stop := make(chan struct{})
+	notifying := make(chan struct{})
+	go func() {
+		defer close(notifying)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				e.Notify(Event{Type: EventVideoStarted})
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e.Flush(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("Flush gave up waiting")
+	}
+
+	before, _ := ioutil.ReadFile(out)
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	<-notifying
+	after, _ := ioutil.ReadFile(out)
+	if len(after) != len(before) {
+		t.Error("commands ran after Flush returned")
+	}
+
+	// flushing again is harmless
+	e.Flush(ctx)
+}
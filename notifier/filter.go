@@ -0,0 +1,56 @@
+package notifier
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Filtered wraps a notifier so that it only receives the given event types
+type Filtered struct {
+	Notifier Notifier
+	Events   map[EventType]bool
+}
+
+var _ Notifier = &Filtered{}
+var _ Flusher = &Filtered{}
+
+// NewFiltered wraps `n` so it only receives the named events. If `events` is empty, every event is passed through.
+// Unknown event names are logged and ignored.
+func NewFiltered(n Notifier, events []string) Notifier {
+	if len(events) == 0 {
+		return n
+	}
+
+	known := make(map[EventType]bool)
+	for _, curr := range AllEventTypes {
+		known[curr] = true
+	}
+
+	allowed := make(map[EventType]bool)
+	for _, curr := range events {
+		eventType := EventType(curr)
+		if !known[eventType] {
+			log.WithField("event", curr).Warn("ignoring unknown event type in notifier filter")
+			continue
+		}
+		allowed[eventType] = true
+	}
+
+	return &Filtered{
+		Notifier: n,
+		Events:   allowed,
+	}
+}
+
+func (f *Filtered) Notify(event Event) {
+	if f.Events[event.Type] {
+		f.Notifier.Notify(event)
+	}
+}
+
+func (f *Filtered) Flush(ctx context.Context) {
+	if flusher, ok := f.Notifier.(Flusher); ok {
+		flusher.Flush(ctx)
+	}
+}
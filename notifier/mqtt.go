@@ -0,0 +1,142 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+
+	// mqttDisconnectQuiesceMs is how long the client gets to finish any work in progress when disconnecting
+	mqttDisconnectQuiesceMs = 250
+)
+
+// Mqtt publishes events to an MQTT broker. Given a base topic of `bucket-stream`, it publishes:
+//
+//	bucket-stream/status        "online" or "offline" (retained, "offline" is also the last will)
+//	bucket-stream/now_playing   the most recent video_started event as JSON (retained)
+//	bucket-stream/events/<type> every event as JSON
+//
+// Publishing is asynchronous. If the broker is unreachable the client keeps retrying in the background. Once the
+// process_exit event has been published, Flush disconnects from the broker.
+type Mqtt struct {
+	sync.Mutex
+
+	Broker string
+	Topic  string
+	Qos    byte
+
+	client    mqtt.Client
+	lastToken mqtt.Token
+	exiting   bool
+}
+
+var _ Notifier = &Mqtt{}
+var _ Flusher = &Mqtt{}
+
+// NewMqtt builds an MQTT notifier and starts connecting to the broker. `broker` is a URL such as
+// `tcp://localhost:1883`, and `qos` must be 0, 1 or 2.
+func NewMqtt(broker string, topic string, qos byte, clientId string, username string, password string) *Mqtt {
+	if clientId == "" {
+		hostname, _ := os.Hostname()
+		clientId = fmt.Sprintf("bucket-stream-%s-%d", hostname, os.Getpid())
+	}
+
+	m := &Mqtt{
+		Broker: broker,
+		Topic:  topic,
+		Qos:    qos,
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(m.topic("status"), mqttStatusOffline, qos, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.WithField("broker", broker).Info("connected to mqtt broker")
+			c.Publish(m.topic("status"), qos, true, mqttStatusOnline)
+		}).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.WithError(err).WithField("broker", broker).Warn("lost connection to mqtt broker")
+		})
+
+	m.client = mqtt.NewClient(opts)
+	m.client.Connect()
+
+	return m
+}
+
+func (m *Mqtt) topic(suffix string) string {
+	return fmt.Sprintf("%s/%s", m.Topic, suffix)
+}
+
+func (m *Mqtt) Notify(event Event) {
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		log.WithError(err).Warn("could not marshal mqtt payload")
+		return
+	}
+
+	m.publish(m.topic("events/"+string(event.Type)), false, payload)
+
+	switch event.Type {
+	case EventVideoStarted:
+		m.publish(m.topic("now_playing"), true, payload)
+	case EventProcessExit:
+		m.publish(m.topic("status"), true, []byte(mqttStatusOffline))
+		m.Lock()
+		m.exiting = true
+		m.Unlock()
+	}
+}
+
+func (m *Mqtt) publish(topic string, retained bool, payload []byte) {
+	token := m.client.Publish(topic, m.Qos, retained, payload)
+
+	m.Lock()
+	m.lastToken = token
+	m.Unlock()
+
+	go func() {
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			log.WithError(err).WithField("topic", topic).Warn("could not publish to mqtt")
+		}
+	}()
+}
+
+// Flush waits for the most recent publish to complete. Since paho completes publishes in order, this covers
+// everything published before it. If the process is exiting, the client is then disconnected.
+func (m *Mqtt) Flush(ctx context.Context) {
+	m.Lock()
+	token := m.lastToken
+	exiting := m.exiting
+	m.Unlock()
+
+	if token != nil {
+		select {
+		case <-token.Done():
+		case <-ctx.Done():
+			log.WithField("broker", m.Broker).Warn("gave up waiting for mqtt publish")
+		}
+	}
+
+	if exiting {
+		m.client.Disconnect(mqttDisconnectQuiesceMs)
+		log.WithField("broker", m.Broker).Info("disconnected from mqtt broker")
+	}
+}
@@ -0,0 +1,116 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// published is one message sent through fakeMqttClient
+type published struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// fakeMqttClient records what is published instead of talking to a broker. Anything it doesn't override panics.
+type fakeMqttClient struct {
+	mqtt.Client
+	sync.Mutex
+
+	published    []published
+	disconnected bool
+}
+
+func (c *fakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+
+	c.published = append(c.published, published{topic: topic, retained: retained, payload: string(payload.([]byte))})
+	return doneToken{}
+}
+
+func (c *fakeMqttClient) Disconnect(quiesce uint) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.disconnected = true
+}
+
+// doneToken is a token for a publish that has already completed
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestMqttTopicsAndPayloads(t *testing.T) {
+	client := &fakeMqttClient{}
+	m := &Mqtt{Topic: "bucket-stream", client: client}
+
+	started := Event{Type: EventVideoStarted, VideoKey: "shows/a.flv", Title: "a", PlayIndex: 1}
+	m.Notify(started)
+	m.Notify(Event{Type: EventVideoFinished, VideoKey: "shows/a.flv", PlayIndex: 1})
+
+	startedJson, _ := json.Marshal(&started)
+	want := []published{
+		{topic: "bucket-stream/events/video_started", payload: string(startedJson)},
+		{topic: "bucket-stream/now_playing", retained: true, payload: string(startedJson)},
+		{topic: "bucket-stream/events/video_finished"},
+	}
+
+	client.Lock()
+	got := client.published
+	client.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("published %d messages, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].topic != want[i].topic || got[i].retained != want[i].retained {
+			t.Errorf("message %d went to %s (retained %v), want %s (retained %v)", i, got[i].topic, got[i].retained,
+				want[i].topic, want[i].retained)
+		}
+		if want[i].payload != "" && got[i].payload != want[i].payload {
+			t.Errorf("message %d payload = %s, want %s", i, got[i].payload, want[i].payload)
+		}
+	}
+
+	var finished Event
+	if err := json.Unmarshal([]byte(got[2].payload), &finished); err != nil || finished.Type != EventVideoFinished {
+		t.Errorf("video_finished payload = %s, want the event as JSON", got[2].payload)
+	}
+
+	// flushing while still running leaves the connection alone
+	m.Flush(context.Background())
+	if client.disconnected {
+		t.Error("Flush disconnected before the process exited")
+	}
+}
+
+func TestMqttDisconnectsOnExit(t *testing.T) {
+	client := &fakeMqttClient{}
+	m := &Mqtt{Topic: "bucket-stream", client: client}
+
+	m.Notify(Event{Type: EventProcessExit})
+
+	client.Lock()
+	last := client.published[len(client.published)-1]
+	client.Unlock()
+	if last.topic != "bucket-stream/status" || !last.retained || last.payload != mqttStatusOffline {
+		t.Errorf("last message = %+v, want a retained offline status", last)
+	}
+
+	m.Flush(context.Background())
+	if !client.disconnected {
+		t.Error("Flush after process_exit did not disconnect")
+	}
+}
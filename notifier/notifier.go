@@ -1,5 +1,100 @@
 package notifier
 
+import (
+	"context"
+	"time"
+)
+
+// EventType identifies what happened in an Event
+type EventType string
+
+const (
+	EventStreamUp          EventType = "stream_up"
+	EventVideoStarted      EventType = "video_started"
+	EventVideoFinished     EventType = "video_finished"
+	EventVideoSkipped      EventType = "video_skipped"
+	EventVideoErrored      EventType = "video_errored"
+	EventLibraryChanged    EventType = "library_changed"
+	EventLibraryEnumerated EventType = "library_enumerated"
+	EventQueueChanged      EventType = "queue_changed"
+	EventStreamPaused      EventType = "stream_paused"
+	EventStreamResumed     EventType = "stream_resumed"
+	EventShutdownRequested EventType = "shutdown_requested"
+	EventProcessExit       EventType = "process_exit"
+
+	// EventProgress is published about once a second while a video plays. It is only available on the event stream
+	// and is never sent to notifiers.
+	EventProgress EventType = "progress"
+)
+
+// AllEventTypes lists every event type a notifier can receive
+var AllEventTypes = []EventType{
+	EventStreamUp,
+	EventVideoStarted,
+	EventVideoFinished,
+	EventVideoSkipped,
+	EventVideoErrored,
+	EventLibraryChanged,
+	EventLibraryEnumerated,
+	EventQueueChanged,
+	EventStreamPaused,
+	EventStreamResumed,
+	EventShutdownRequested,
+	EventProcessExit,
+}
+
+// Event describes something that happened to the stream. Only the fields relevant to the event type are filled in.
+type Event struct {
+	Type      EventType `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+
+	VideoKey        string     `json:"video_key,omitempty"`
+	Title           string     `json:"title,omitempty"`
+	PlayIndex       int        `json:"play_index,omitempty"`
+	VideoStartedAt  *time.Time `json:"video_started_at,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+
+	// NextVideoKey and NextTitle describe the video that will play after this one, when that is already known
+	NextVideoKey string `json:"next_video_key,omitempty"`
+	NextTitle    string `json:"next_title,omitempty"`
+
+	VideoCount int      `json:"video_count,omitempty"`
+	Queue      []string `json:"queue,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Notifier is told about things happening on the stream. Implementations are called from the main loop and should
+// not block.
 type Notifier interface {
-	Notify(name string)
-}
\ No newline at end of file
+	Notify(event Event)
+}
+
+// Flusher is implemented by notifiers that deliver in the background. Flush blocks until everything queued so far has
+// been delivered (or given up on) or the context is done.
+type Flusher interface {
+	Flush(ctx context.Context)
+}
+
+// Multi fans an event out to every notifier in the list
+type Multi []Notifier
+
+var _ Notifier = Multi{}
+var _ Flusher = Multi{}
+
+func (m Multi) Notify(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	for _, curr := range m {
+		curr.Notify(event)
+	}
+}
+
+func (m Multi) Flush(ctx context.Context) {
+	for _, curr := range m {
+		if f, ok := curr.(Flusher); ok {
+			f.Flush(ctx)
+		}
+	}
+}
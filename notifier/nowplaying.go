@@ -0,0 +1,78 @@
+package notifier
+
+import (
+	"encoding/json"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lthummus/bucket-stream/atomicfile"
+)
+
+// NowPlayingFile keeps a set of local files up to date with what is playing, for overlay tools that read plain files.
+// Any of the paths may be left blank to skip that file. Files are replaced atomically, so readers never see a partial
+// write. The next title and the JSON are rewritten whenever the queue changes, since that changes what plays next.
+type NowPlayingFile struct {
+	sync.Mutex
+
+	TitlePath     string
+	NextTitlePath string
+	JsonPath      string
+
+	// playing is the video_started event for the current video, kept so the JSON can be updated when the queue changes
+	playing *Event
+}
+
+var _ Notifier = &NowPlayingFile{}
+
+func (n *NowPlayingFile) Notify(event Event) {
+	n.Lock()
+	defer n.Unlock()
+
+	switch event.Type {
+	case EventVideoStarted:
+		n.playing = &event
+		n.write(n.TitlePath, []byte(event.Title))
+		n.write(n.NextTitlePath, []byte(event.NextTitle))
+		n.writeJson()
+	case EventQueueChanged:
+		n.write(n.NextTitlePath, []byte(event.NextTitle))
+		if n.playing != nil {
+			n.playing.NextVideoKey = event.NextVideoKey
+			n.playing.NextTitle = event.NextTitle
+			n.playing.Queue = event.Queue
+			n.writeJson()
+		}
+	case EventProcessExit:
+		n.playing = nil
+		n.write(n.TitlePath, []byte{})
+		n.write(n.NextTitlePath, []byte{})
+		n.write(n.JsonPath, []byte("{}"))
+	}
+}
+
+// writeJson writes the current video out to the JSON file. Must be called with the lock held.
+func (n *NowPlayingFile) writeJson() {
+	if n.JsonPath == "" {
+		return
+	}
+
+	payload, err := json.MarshalIndent(n.playing, "", "  ")
+	if err != nil {
+		log.WithError(err).Warn("could not marshal now playing json")
+		return
+	}
+	n.write(n.JsonPath, payload)
+}
+
+// write atomically replaces the file at `path` with `contents`
+func (n *NowPlayingFile) write(path string, contents []byte) {
+	if path == "" {
+		return
+	}
+
+	// other local processes need to read these
+	if err := atomicfile.WriteFile(path, contents, 0644); err != nil {
+		log.WithError(err).WithField("path", path).Warn("could not write now playing file")
+	}
+}
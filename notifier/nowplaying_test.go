@@ -0,0 +1,93 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNowPlayingFile(t *testing.T) {
+	dir := t.TempDir()
+	n := &NowPlayingFile{
+		TitlePath:     filepath.Join(dir, "title.txt"),
+		NextTitlePath: filepath.Join(dir, "next.txt"),
+		JsonPath:      filepath.Join(dir, "now_playing.json"),
+	}
+
+	read := func(path string) string {
+		t.Helper()
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	readJson := func() Event {
+		t.Helper()
+		var event Event
+		if err := json.Unmarshal([]byte(read(n.JsonPath)), &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	// a queue change before anything plays still says what is next
+	n.Notify(Event{Type: EventQueueChanged, Queue: []string{"b.flv"}, NextVideoKey: "b.flv", NextTitle: "b"})
+	if got := read(n.NextTitlePath); got != "b" {
+		t.Errorf("next title = %q, want b", got)
+	}
+
+	n.Notify(Event{Type: EventVideoStarted, VideoKey: "a.flv", Title: "a", NextVideoKey: "c.flv", NextTitle: "c"})
+	if got := read(n.TitlePath); got != "a" {
+		t.Errorf("title = %q, want a", got)
+	}
+	if got := read(n.NextTitlePath); got != "c" {
+		t.Errorf("next title = %q, want c", got)
+	}
+	if got := readJson(); got.VideoKey != "a.flv" || got.NextTitle != "c" {
+		t.Errorf("json = %+v, want a.flv with c next", got)
+	}
+
+	// queueing something changes what's next without touching what's playing
+	n.Notify(Event{Type: EventQueueChanged, Queue: []string{"d.flv", "e.flv"}, NextVideoKey: "d.flv", NextTitle: "d"})
+	if got := read(n.TitlePath); got != "a" {
+		t.Errorf("title = %q after a queue change, want a", got)
+	}
+	if got := read(n.NextTitlePath); got != "d" {
+		t.Errorf("next title = %q after a queue change, want d", got)
+	}
+	got := readJson()
+	if got.Type != EventVideoStarted || got.VideoKey != "a.flv" || got.NextVideoKey != "d.flv" || got.NextTitle != "d" ||
+		!reflect.DeepEqual(got.Queue, []string{"d.flv", "e.flv"}) {
+		t.Errorf("json = %+v after a queue change, want a.flv with d next", got)
+	}
+
+	// clearing the queue with nothing else lined up leaves the next title blank
+	n.Notify(Event{Type: EventQueueChanged})
+	if got := read(n.NextTitlePath); got != "" {
+		t.Errorf("next title = %q after clearing the queue, want it blank", got)
+	}
+
+	n.Notify(Event{Type: EventProcessExit})
+	if read(n.TitlePath) != "" || read(n.NextTitlePath) != "" || read(n.JsonPath) != "{}" {
+		t.Error("files weren't cleared on exit")
+	}
+}
+
+func TestNowPlayingFileSkipsBlankPaths(t *testing.T) {
+	dir := t.TempDir()
+	n := &NowPlayingFile{TitlePath: filepath.Join(dir, "title.txt")}
+
+	n.Notify(Event{Type: EventVideoStarted, VideoKey: "a.flv", Title: "a"})
+	n.Notify(Event{Type: EventQueueChanged, NextTitle: "b"})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("wrote %d files, want only the title", len(files))
+	}
+}
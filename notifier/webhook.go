@@ -2,25 +2,91 @@ package notifier
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+const (
+	defaultWebhookTimeoutSeconds = 10
+	defaultWebhookMaxAttempts    = 5
+	defaultWebhookQueueSize      = 100
+	defaultWebhookInitialBackoff = 1 * time.Second
+	maxWebhookBackoff            = 1 * time.Minute
+)
+
+// Webhook delivers notifications to an HTTP endpoint. Deliveries are queued and sent in order by a single background
+// worker per endpoint, so a slow or failing endpoint never holds up the main loop. Failed requests are retried with
+// exponential backoff and, once out of attempts, written to the dead letter log so they can be replayed later.
 type Webhook struct {
 	Url string
+
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	queue          chan []byte
+	pending        int64
+	deadLetters    *DeadLetterLog
 }
 
 var _ Notifier = &Webhook{}
+var _ Flusher = &Webhook{}
+
+// NewWebhook builds a webhook notifier for the given URL and starts its delivery worker. Timeouts, retry counts and
+// the queue size are read from the `webhook` section of the config. Undeliverable payloads are written to
+// `deadLetters`, which may be nil if dead lettering is not wanted.
+func NewWebhook(url string, deadLetters *DeadLetterLog) *Webhook {
+	timeoutSeconds := defaultWebhookTimeoutSeconds
+	if configTimeout := viper.GetInt("webhook.timeout_seconds"); configTimeout != 0 {
+		timeoutSeconds = configTimeout
+	}
+
+	maxAttempts := defaultWebhookMaxAttempts
+	if configAttempts := viper.GetInt("webhook.max_attempts"); configAttempts != 0 {
+		maxAttempts = configAttempts
+	}
+
+	queueSize := defaultWebhookQueueSize
+	if configQueueSize := viper.GetInt("webhook.queue_size"); configQueueSize != 0 {
+		queueSize = configQueueSize
+	}
 
-var client = http.Client{}
+	w := &Webhook{
+		Url: url,
+		client: &http.Client{
+			Timeout: time.Duration(timeoutSeconds) * time.Second,
+		},
+		maxAttempts:    maxAttempts,
+		initialBackoff: defaultWebhookInitialBackoff,
+		queue:          make(chan []byte, queueSize),
+		deadLetters:    deadLetters,
+	}
+
+	if deadLetters != nil {
+		deadLetters.register(w)
+	}
 
-func (w *Webhook) Notify(name string) {
+	go w.deliveryWorker()
+
+	return w
+}
+
+// Notify queues the event for delivery. The payload is the event itself plus a `name` field holding the title, which
+// is what older webhook consumers expect.
+func (w *Webhook) Notify(event Event) {
 	payload := struct {
-		Name string `json:"name"`
+		Event
+		Name string `json:"name,omitempty"`
 	}{
-		name,
+		event,
+		event.Title,
 	}
 
 	jsonPayload, err := json.Marshal(&payload)
@@ -29,28 +95,125 @@ func (w *Webhook) Notify(name string) {
 		return
 	}
 
-	req, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewBuffer(jsonPayload))
+	w.enqueue(jsonPayload)
+}
+
+// enqueue hands a payload to the delivery worker without blocking. If the queue is full, the payload goes straight
+// to the dead letter log.
+func (w *Webhook) enqueue(payload []byte) {
+	if !w.offer(payload) {
+		log.WithField("url", w.Url).Warn("webhook delivery queue full")
+		w.deadLetter(payload, 0, errors.New("delivery queue full"))
+	}
+}
+
+// offer hands a payload to the delivery worker without blocking, returning false if the queue is full
+func (w *Webhook) offer(payload []byte) bool {
+	atomic.AddInt64(&w.pending, 1)
+	select {
+	case w.queue <- payload:
+		return true
+	default:
+		atomic.AddInt64(&w.pending, -1)
+		return false
+	}
+}
+
+func (w *Webhook) deliveryWorker() {
+	for payload := range w.queue {
+		w.deliver(payload)
+		atomic.AddInt64(&w.pending, -1)
+	}
+}
+
+// Flush waits for the delivery queue to drain. Payloads that are still retrying when the context ends are not dead
+// lettered, so this should be given enough time for the configured retries.
+func (w *Webhook) Flush(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&w.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{
+				"url":     w.Url,
+				"pending": atomic.LoadInt64(&w.pending),
+			}).Warn("gave up waiting for webhook deliveries")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver attempts to send a single payload, backing off exponentially between attempts. Deliveries for an endpoint
+// are strictly sequential, so a retrying payload holds back the ones queued after it and ordering is preserved.
+func (w *Webhook) deliver(payload []byte) {
+	backoff := w.initialBackoff
+
+	var err error
+	for attempt := 1; attempt <= w.maxAttempts; attempt++ {
+		err = w.send(payload)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"url":     w.Url,
+				"attempt": attempt,
+			}).Info("webhook updated")
+			return
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"url":     w.Url,
+			"attempt": attempt,
+		}).Warn("webhook delivery failed")
+
+		if attempt < w.maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxWebhookBackoff {
+				backoff = maxWebhookBackoff
+			}
+		}
+	}
+
+	w.deadLetter(payload, w.maxAttempts, err)
+}
+
+func (w *Webhook) send(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewBuffer(payload))
 	if err != nil {
-		log.WithError(err).Warn("could not create webhook update request")
-		return
+		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := w.client.Do(req)
 	if err != nil {
-		log.WithError(err).Warn("could not execute webhook request")
-		return
+		return err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		log.WithFields(log.Fields{
-			"status_code": resp.StatusCode,
-		}).Warn("non 2xx response code from webhook server")
+		return fmt.Errorf("non 2xx response code from webhook server: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *Webhook) deadLetter(payload []byte, attempts int, cause error) {
+	if w.deadLetters == nil {
+		log.WithField("url", w.Url).Warn("dropping undeliverable webhook payload")
 		return
 	}
 
-	log.WithField("video", name).Info("webhook updated")
-}
\ No newline at end of file
+	err := w.deadLetters.Write(DeadLetter{
+		Url:      w.Url,
+		Payload:  payload,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		log.WithError(err).WithField("url", w.Url).Error("could not write webhook dead letter")
+	}
+}
@@ -0,0 +1,171 @@
+package notifier
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEndpoint is a webhook receiver that answers each request with the next status in `statuses`, repeating the last
+// one, and records what it was sent and when
+type fakeEndpoint struct {
+	sync.Mutex
+
+	statuses []int
+	payloads []string
+	times    []time.Time
+}
+
+func (e *fakeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	e.Lock()
+	defer e.Unlock()
+
+	status := e.statuses[len(e.statuses)-1]
+	if len(e.payloads) < len(e.statuses) {
+		status = e.statuses[len(e.payloads)]
+	}
+	e.payloads = append(e.payloads, string(body))
+	e.times = append(e.times, time.Now())
+	w.WriteHeader(status)
+}
+
+func (e *fakeEndpoint) received() []string {
+	e.Lock()
+	defer e.Unlock()
+
+	return append([]string(nil), e.payloads...)
+}
+
+// testWebhook builds a webhook for `url` with short backoffs. The delivery worker is only started if `start` is set,
+// so tests can fill the queue.
+func testWebhook(url string, maxAttempts int, queueSize int, deadLetters *DeadLetterLog, start bool) *Webhook {
+	w := &Webhook{
+		Url:            url,
+		client:         &http.Client{Timeout: 5 * time.Second},
+		maxAttempts:    maxAttempts,
+		initialBackoff: 20 * time.Millisecond,
+		queue:          make(chan []byte, queueSize),
+		deadLetters:    deadLetters,
+	}
+	if deadLetters != nil {
+		deadLetters.register(w)
+	}
+	if start {
+		go w.deliveryWorker()
+	}
+	return w
+}
+
+func flushWebhook(t *testing.T, w *Webhook) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w.Flush(ctx)
+	if atomic.LoadInt64(&w.pending) != 0 {
+		t.Fatal("deliveries still pending after flush")
+	}
+}
+
+func readDeadLetters(t *testing.T, d *DeadLetterLog) []DeadLetter {
+	t.Helper()
+
+	d.Lock()
+	defer d.Unlock()
+	entries, err := d.readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	endpoint := &fakeEndpoint{statuses: []int{500, 502, 200}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+
+	w := testWebhook(server.URL, 5, 10, deadLetters, true)
+	w.Notify(Event{Type: EventVideoStarted, Title: "a"})
+	flushWebhook(t, w)
+
+	endpoint.Lock()
+	times := endpoint.times
+	payloads := endpoint.payloads
+	endpoint.Unlock()
+	if len(times) != 3 {
+		t.Fatalf("endpoint got %d requests, want 2 failures and a success", len(times))
+	}
+	if payloads[2] != payloads[0] || !strings.Contains(payloads[0], `"name":"a"`) {
+		t.Errorf("retries sent %s, want the same payload as the first attempt %s", payloads[2], payloads[0])
+	}
+	// the backoff doubles after each failure
+	if gap := times[1].Sub(times[0]); gap < 20*time.Millisecond {
+		t.Errorf("first retry after %s, want at least 20ms", gap)
+	}
+	if gap := times[2].Sub(times[1]); gap < 40*time.Millisecond {
+		t.Errorf("second retry after %s, want at least 40ms", gap)
+	}
+	if entries := readDeadLetters(t, deadLetters); len(entries) != 0 {
+		t.Errorf("%d dead letters written for a delivery that succeeded", len(entries))
+	}
+}
+
+func TestWebhookDeadLettersAfterLastAttempt(t *testing.T) {
+	endpoint := &fakeEndpoint{statuses: []int{500}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+
+	w := testWebhook(server.URL, 3, 10, deadLetters, true)
+	w.Notify(Event{Type: EventVideoStarted})
+	w.Notify(Event{Type: EventVideoFinished})
+	flushWebhook(t, w)
+
+	if got := len(endpoint.received()); got != 6 {
+		t.Errorf("endpoint got %d requests, want 3 attempts for each event", got)
+	}
+
+	entries := readDeadLetters(t, deadLetters)
+	if len(entries) != 2 {
+		t.Fatalf("%d dead letters, want 2", len(entries))
+	}
+	for i, want := range []EventType{EventVideoStarted, EventVideoFinished} {
+		entry := entries[i]
+		if entry.Url != server.URL || entry.Attempts != 3 || !strings.Contains(entry.Error, "500") {
+			t.Errorf("dead letter %d = %+v, want 3 failed attempts at %s", i, entry, server.URL)
+		}
+		if !strings.Contains(string(entry.Payload), string(want)) {
+			t.Errorf("dead letter %d has payload %s, want the %s event", i, entry.Payload, want)
+		}
+	}
+}
+
+func TestWebhookDeadLettersWhenQueueIsFull(t *testing.T) {
+	deadLetters := NewDeadLetterLog(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+
+	// nothing is taking from the queue, so the second event doesn't fit
+	w := testWebhook("http://localhost/hook", 3, 1, deadLetters, false)
+	w.Notify(Event{Type: EventVideoStarted})
+	w.Notify(Event{Type: EventVideoFinished})
+
+	entries := readDeadLetters(t, deadLetters)
+	if len(entries) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(entries))
+	}
+	if entries[0].Attempts != 0 || !strings.Contains(string(entries[0].Payload), string(EventVideoFinished)) {
+		t.Errorf("dead letter = %+v, want the second event with no attempts", entries[0])
+	}
+	if pending := atomic.LoadInt64(&w.pending); pending != 1 {
+		t.Errorf("%d deliveries pending, want just the one that was queued", pending)
+	}
+}
@@ -0,0 +1,217 @@
+// Package picker holds the strategies for choosing which video plays next. Each one picks at random, with each
+// candidate's chance in proportion to its weight adjusted by the strategy. The random number generator is passed in
+// so a fixed seed gives repeatable picks.
+package picker
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	StrategyUniform       = "uniform"
+	StrategyWeighted      = "weighted"
+	StrategyRarelyPlayed  = "rarely_played"
+	StrategyRecentlyAdded = "recently_added"
+	StrategyDecay         = "decay"
+
+	defaultRecentlyAddedHalfLife = 7 * 24 * time.Hour
+	defaultDecayHalfLife         = 24 * time.Hour
+	defaultBoost                 = 4
+
+	// minimumScore keeps every candidate in the running, so a strategy can never rule everything out
+	minimumScore = 0.001
+)
+
+// Weights gives videos extra weight by key prefix, so a folder (or a single video) can be made more or less likely.
+// The longest matching prefix wins. As with every other weight, zero means unset and counts as 1.
+type Weights map[string]float64
+
+// For returns a video's weight: its own weight (from its source, manifest or sidecar) scaled by the longest matching
+// prefix
+func (w Weights) For(v videostorage.Video) float64 {
+	weight := v.EffectiveWeight()
+
+	longest := -1
+	factor := 1.0
+	for prefix, curr := range w {
+		if strings.HasPrefix(v.Key, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			factor = curr
+		}
+	}
+	if factor <= 0 {
+		factor = 1
+	}
+
+	return weight * factor
+}
+
+// Uniform ignores weights and gives every video the same chance
+type Uniform struct {
+	Rand *rand.Rand
+}
+
+func (p *Uniform) Pick(candidates []videostorage.Video) videostorage.Video {
+	return candidates[p.Rand.Intn(len(candidates))]
+}
+
+// Weighted picks in proportion to each video's weight
+type Weighted struct {
+	Rand    *rand.Rand
+	Weights Weights
+}
+
+func (p *Weighted) Pick(candidates []videostorage.Video) videostorage.Video {
+	return pickScored(p.Rand, candidates, p.Weights.For)
+}
+
+// RarelyPlayed favours videos that have been played the fewest times: a video played n times is 1/(n+1) as likely
+// as it would otherwise be
+type RarelyPlayed struct {
+	Rand    *rand.Rand
+	Weights Weights
+}
+
+func (p *RarelyPlayed) Pick(candidates []videostorage.Video) videostorage.Video {
+	return pickScored(p.Rand, candidates, func(v videostorage.Video) float64 {
+		return p.Weights.For(v) / float64(v.PlayCount+1)
+	})
+}
+
+// RecentlyAdded favours videos that were uploaded recently. A brand new video is `1 + Boost` times as likely as it
+// would otherwise be, and the extra chance halves every `HalfLife`.
+type RecentlyAdded struct {
+	Rand     *rand.Rand
+	Weights  Weights
+	HalfLife time.Duration
+	Boost    float64
+	Now      func() time.Time
+}
+
+func (p *RecentlyAdded) Pick(candidates []videostorage.Video) videostorage.Video {
+	now := currentTime(p.Now)
+	return pickScored(p.Rand, candidates, func(v videostorage.Video) float64 {
+		age := now.Sub(v.LastModified)
+		if age < 0 {
+			age = 0
+		}
+		return p.Weights.For(v) * (1 + p.Boost*halving(age, p.HalfLife))
+	})
+}
+
+// Decay makes videos that played recently less likely. A video that just finished has almost no chance, and half its
+// usual chance after `HalfLife`. Videos that have never played have their full chance.
+type Decay struct {
+	Rand     *rand.Rand
+	Weights  Weights
+	HalfLife time.Duration
+	Now      func() time.Time
+}
+
+func (p *Decay) Pick(candidates []videostorage.Video) videostorage.Video {
+	now := currentTime(p.Now)
+	return pickScored(p.Rand, candidates, func(v videostorage.Video) float64 {
+		if v.LastPlayed == nil {
+			return p.Weights.For(v)
+		}
+		return p.Weights.For(v) * (1 - halving(now.Sub(*v.LastPlayed), p.HalfLife))
+	})
+}
+
+// FromConfig reads the `picker` section of the config. Without one, videos are picked in proportion to their weights.
+func FromConfig(rnd *rand.Rand) videostorage.Picker {
+	var configs []struct {
+		Prefix string  `mapstructure:"prefix"`
+		Weight float64 `mapstructure:"weight"`
+	}
+	if err := viper.UnmarshalKey("picker.weights", &configs); err != nil {
+		log.WithError(err).Fatal("could not read picker weights")
+	}
+
+	weights := make(Weights)
+	for _, curr := range configs {
+		if curr.Weight < 0 {
+			log.WithField("prefix", curr.Prefix).Fatal("picker weights can't be negative")
+		}
+		if curr.Weight == 0 {
+			log.WithField("prefix", curr.Prefix).Warn("picker weight of 0 counts as 1. to stop videos playing, exclude them from their source")
+		}
+		weights[curr.Prefix] = curr.Weight
+	}
+
+	halfLife := time.Duration(viper.GetFloat64("picker.half_life_hours") * float64(time.Hour))
+	boost := viper.GetFloat64("picker.boost")
+	if boost == 0 {
+		boost = defaultBoost
+	}
+
+	strategy := viper.GetString("picker.strategy")
+	log.WithFields(log.Fields{
+		"strategy": strategy,
+		"weights":  len(weights),
+	}).Info("configured video picker")
+
+	switch strategy {
+	case "", StrategyWeighted:
+		return &Weighted{Rand: rnd, Weights: weights}
+	case StrategyUniform:
+		return &Uniform{Rand: rnd}
+	case StrategyRarelyPlayed:
+		return &RarelyPlayed{Rand: rnd, Weights: weights}
+	case StrategyRecentlyAdded:
+		if halfLife == 0 {
+			halfLife = defaultRecentlyAddedHalfLife
+		}
+		return &RecentlyAdded{Rand: rnd, Weights: weights, HalfLife: halfLife, Boost: boost}
+	case StrategyDecay:
+		if halfLife == 0 {
+			halfLife = defaultDecayHalfLife
+		}
+		return &Decay{Rand: rnd, Weights: weights, HalfLife: halfLife}
+	default:
+		log.WithField("strategy", strategy).Fatal("unknown picker strategy")
+		return nil
+	}
+}
+
+// pickScored picks a candidate at random in proportion to its score
+func pickScored(rnd *rand.Rand, candidates []videostorage.Video, score func(videostorage.Video) float64) videostorage.Video {
+	scores := make([]float64, len(candidates))
+	total := 0.0
+	for i, curr := range candidates {
+		scores[i] = math.Max(score(curr), minimumScore)
+		total += scores[i]
+	}
+
+	target := rnd.Float64() * total
+	for i, curr := range candidates {
+		target -= scores[i]
+		if target < 0 {
+			return curr
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// halving is 1 at zero and halves every `halfLife`
+func halving(elapsed time.Duration, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return 0
+	}
+	return math.Pow(0.5, float64(elapsed)/float64(halfLife))
+}
+
+func currentTime(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
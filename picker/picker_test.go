@@ -0,0 +1,176 @@
+package picker
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const picks = 20000
+
+// pickCounts runs a picker many times over the same candidates and counts how often each key comes up
+func pickCounts(p videostorage.Picker, candidates []videostorage.Video) map[string]int {
+	res := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		res[p.Pick(candidates).Key]++
+	}
+	return res
+}
+
+// assertShare checks that `key` was picked about `want` of the time
+func assertShare(t *testing.T, counts map[string]int, key string, want float64) {
+	t.Helper()
+
+	got := float64(counts[key]) / picks
+	if math.Abs(got-want) > 0.02 {
+		t.Errorf("%s picked %.3f of the time, want about %.3f", key, got, want)
+	}
+}
+
+func seeded() *rand.Rand {
+	return rand.New(rand.NewSource(42))
+}
+
+func TestWeightsFor(t *testing.T) {
+	weights := Weights{
+		"shows/":          2,
+		"shows/news/":     0.5,
+		"shows/news/a.fl": 10,
+		"shows/news/zero": 0,
+	}
+
+	tests := []struct {
+		name  string
+		video videostorage.Video
+		want  float64
+	}{
+		{"no matching prefix", videostorage.Video{Key: "movies/a.flv"}, 1},
+		{"folder", videostorage.Video{Key: "shows/b.flv"}, 2},
+		{"longest prefix wins", videostorage.Video{Key: "shows/news/b.flv"}, 0.5},
+		{"prefix of a single video", videostorage.Video{Key: "shows/news/a.flv"}, 10},
+		{"scales the video's own weight", videostorage.Video{Key: "shows/b.flv", Weight: 3}, 6},
+		{"own weight without a prefix", videostorage.Video{Key: "movies/a.flv", Weight: 3}, 3},
+		{"zero prefix weight counts as 1", videostorage.Video{Key: "shows/news/zero.flv", Weight: 3}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := weights.For(tt.video); got != tt.want {
+				t.Errorf("For(%s) = %v, want %v", tt.video.Key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniform(t *testing.T) {
+	p := &Uniform{Rand: seeded()}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "a", Weight: 10},
+		{Key: "b"},
+	})
+
+	assertShare(t, counts, "a", 0.5)
+	assertShare(t, counts, "b", 0.5)
+}
+
+func TestWeighted(t *testing.T) {
+	p := &Weighted{Rand: seeded(), Weights: Weights{"boosted/": 2}}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "a", Weight: 3},
+		{Key: "b"},
+		{Key: "boosted/c"},
+		{Key: "d", Weight: 2},
+	})
+
+	// weights 3, 1, 2, 2
+	assertShare(t, counts, "a", 3.0/8)
+	assertShare(t, counts, "b", 1.0/8)
+	assertShare(t, counts, "boosted/c", 2.0/8)
+	assertShare(t, counts, "d", 2.0/8)
+}
+
+func TestWeightedZeroPrefixWeight(t *testing.T) {
+	p := &Weighted{Rand: seeded(), Weights: Weights{"shows/": 4, "shows/reruns/": 0}}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "shows/reruns/a"},
+		{Key: "shows/b"},
+		{Key: "c", Weight: 0},
+	})
+
+	// zero means unset, so the reruns and c count as 1, the same as a video no prefix matches
+	assertShare(t, counts, "shows/reruns/a", 1.0/6)
+	assertShare(t, counts, "shows/b", 4.0/6)
+	assertShare(t, counts, "c", 1.0/6)
+}
+
+func TestRarelyPlayed(t *testing.T) {
+	p := &RarelyPlayed{Rand: seeded()}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "never"},
+		{Key: "once", PlayCount: 1},
+		{Key: "thrice", PlayCount: 3},
+	})
+
+	// scores 1, 1/2, 1/4
+	assertShare(t, counts, "never", 4.0/7)
+	assertShare(t, counts, "once", 2.0/7)
+	assertShare(t, counts, "thrice", 1.0/7)
+}
+
+func TestRecentlyAdded(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &RecentlyAdded{
+		Rand:     seeded(),
+		HalfLife: 24 * time.Hour,
+		Boost:    4,
+		Now:      func() time.Time { return now },
+	}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "new", LastModified: now},
+		{Key: "day old", LastModified: now.Add(-24 * time.Hour)},
+		{Key: "ancient", LastModified: now.AddDate(-1, 0, 0)},
+	})
+
+	// scores 1+4, 1+2, about 1
+	assertShare(t, counts, "new", 5.0/9)
+	assertShare(t, counts, "day old", 3.0/9)
+	assertShare(t, counts, "ancient", 1.0/9)
+}
+
+func TestDecay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	justPlayed := now
+	dayAgo := now.Add(-24 * time.Hour)
+	p := &Decay{
+		Rand:     seeded(),
+		HalfLife: 24 * time.Hour,
+		Now:      func() time.Time { return now },
+	}
+	counts := pickCounts(p, []videostorage.Video{
+		{Key: "never"},
+		{Key: "day ago", LastPlayed: &dayAgo},
+		{Key: "just played", LastPlayed: &justPlayed},
+	})
+
+	// scores 1, 1/2, the minimum
+	assertShare(t, counts, "never", 2.0/3)
+	assertShare(t, counts, "day ago", 1.0/3)
+	if counts["just played"] > picks/100 {
+		t.Errorf("video that just played was picked %d times", counts["just played"])
+	}
+}
+
+func TestSameSeedSamePicks(t *testing.T) {
+	candidates := []videostorage.Video{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "d"}}
+	first := &Weighted{Rand: seeded()}
+	second := &Weighted{Rand: seeded()}
+
+	for i := 0; i < 100; i++ {
+		if a, b := first.Pick(candidates).Key, second.Pick(candidates).Key; a != b {
+			t.Fatalf("pick %d differs with the same seed: %s and %s", i, a, b)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package picker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/atomicfile"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	defaultRunLength          = 3
+	defaultSeriesProgressFile = "series-progress.json"
+)
+
+// episodePattern finds `S01E02` style numbering in a file name
+var episodePattern = regexp.MustCompile(`(?i)^(.*?)[\s._-]*s(\d{1,3})[\s._-]*e(\d{1,4})`)
+
+// episode is where a video sits in its series
+type episode struct {
+	Key     string `json:"key"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+}
+
+// before reports whether `e` comes before `other` in the series
+func (e episode) before(other episode) bool {
+	if e.Season != other.Season {
+		return e.Season < other.Season
+	}
+	if e.Episode != other.Episode {
+		return e.Episode < other.Episode
+	}
+	return e.Key < other.Key
+}
+
+// Series wraps another picker so that series play in order. When the wrapped picker lands on any episode of a series,
+// the episode after the last one played is picked instead, and then the following picks carry on through the series
+// until `RunLength` episodes have played or the series ends. Progress through each series is saved to `ProgressFile`
+// so it carries on where it left off after a restart.
+//
+// A video is part of a series if its manifest or sidecar metadata has a `series` (ordered by `season` and `episode`),
+// if its file name has `S01E02` style numbering (the series being the folder plus whatever comes before the
+// numbering), or if it is directly inside a folder under one of `Folders` (ordered by key).
+type Series struct {
+	sync.Mutex
+
+	Picker       videostorage.Picker
+	RunLength    int
+	Folders      []string
+	ProgressFile string
+
+	progress  map[string]episode
+	run       string
+	remaining int
+}
+
+var _ videostorage.Picker = &Series{}
+var _ videostorage.PlayRecorder = &Series{}
+
+// SeriesFromConfig reads the `series` section of the config and wraps `p` in series mode. Returns nil if series mode
+// is turned off.
+func SeriesFromConfig(p videostorage.Picker) *Series {
+	if !viper.GetBool("series.enabled") {
+		return nil
+	}
+
+	s := &Series{
+		Picker:       p,
+		RunLength:    viper.GetInt("series.run_length"),
+		Folders:      viper.GetStringSlice("series.folders"),
+		ProgressFile: viper.GetString("series.progress_file"),
+		progress:     make(map[string]episode),
+	}
+	if s.RunLength == 0 {
+		s.RunLength = defaultRunLength
+	}
+	if s.ProgressFile == "" {
+		s.ProgressFile = defaultSeriesProgressFile
+	}
+
+	contents, err := ioutil.ReadFile(s.ProgressFile)
+	if err == nil {
+		if err := json.Unmarshal(contents, &s.progress); err != nil {
+			log.WithError(err).WithField("file", s.ProgressFile).Warn("series progress is corrupt, starting over")
+			s.progress = make(map[string]episode)
+		}
+	} else if !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", s.ProgressFile).Warn("could not read series progress")
+	}
+
+	log.WithFields(log.Fields{
+		"run_length": s.RunLength,
+		"series":     len(s.progress),
+	}).Info("series mode enabled")
+	return s
+}
+
+// identify works out which series a video belongs to, if any
+func (s *Series) identify(v videostorage.Video) (string, episode, bool) {
+	ep := episode{Key: v.Key}
+
+	if name := v.Metadata["series"]; name != "" {
+		ep.Season, _ = strconv.Atoi(v.Metadata["season"])
+		ep.Episode, _ = strconv.Atoi(v.Metadata["episode"])
+		return name, ep, true
+	}
+
+	folder, file := path.Split(v.Key)
+	if match := episodePattern.FindStringSubmatch(file); match != nil {
+		ep.Season, _ = strconv.Atoi(match[2])
+		ep.Episode, _ = strconv.Atoi(match[3])
+		return folder + strings.ToLower(strings.TrimSpace(match[1])), ep, true
+	}
+
+	for _, curr := range s.Folders {
+		rest := strings.TrimPrefix(v.Key, curr)
+		if rest == v.Key {
+			continue
+		}
+		if parts := strings.Split(rest, "/"); len(parts) == 2 {
+			return curr + parts[0] + "/", ep, true
+		}
+	}
+
+	return "", ep, false
+}
+
+// nextEpisode finds the episode of `series` that comes after the last one played, going back to the start once the
+// series is over (in which case `wrapped` is true). Only the candidates are considered.
+func (s *Series) nextEpisode(series string, candidates []videostorage.Video) (next videostorage.Video, wrapped bool, ok bool) {
+	type candidate struct {
+		video   videostorage.Video
+		episode episode
+	}
+
+	var episodes []candidate
+	for _, curr := range candidates {
+		if name, ep, ok := s.identify(curr); ok && name == series {
+			episodes = append(episodes, candidate{curr, ep})
+		}
+	}
+	if len(episodes) == 0 {
+		return videostorage.Video{}, false, false
+	}
+
+	sort.Slice(episodes, func(i, j int) bool {
+		return episodes[i].episode.before(episodes[j].episode)
+	})
+
+	last, ok := s.progress[series]
+	if !ok {
+		return episodes[0].video, false, true
+	}
+	for _, curr := range episodes {
+		if last.before(curr.episode) {
+			return curr.video, false, true
+		}
+	}
+	return episodes[0].video, true, true
+}
+
+func (s *Series) Pick(candidates []videostorage.Video) videostorage.Video {
+	s.Lock()
+	defer s.Unlock()
+
+	// a run carries on until it is long enough or the series is over
+	if s.run != "" && s.remaining > 0 {
+		if next, wrapped, ok := s.nextEpisode(s.run, candidates); ok && !wrapped {
+			return next
+		}
+	}
+
+	choice := s.Picker.Pick(candidates)
+	if series, _, ok := s.identify(choice); ok {
+		if next, _, ok := s.nextEpisode(series, candidates); ok {
+			return next
+		}
+	}
+	return choice
+}
+
+// RecordPlay moves a series on when one of its episodes plays, starting a new run if it isn't the series currently
+// running
+func (s *Series) RecordPlay(v videostorage.Video) {
+	s.Lock()
+	defer s.Unlock()
+
+	series, ep, ok := s.identify(v)
+	if !ok {
+		return
+	}
+
+	// going back to an earlier episode means the series started over, which is a new run too
+	last, played := s.progress[series]
+	restarted := played && !last.before(ep)
+
+	if series != s.run || s.remaining <= 0 || restarted {
+		s.run = series
+		s.remaining = s.RunLength
+		log.WithFields(log.Fields{
+			"series":     series,
+			"run_length": s.RunLength,
+		}).Info("starting series run")
+	}
+	s.remaining--
+	s.progress[series] = ep
+
+	if err := s.save(); err != nil {
+		log.WithError(err).WithField("file", s.ProgressFile).Warn("could not save series progress")
+	}
+}
+
+// save writes the progress out atomically. Must be called with the lock held.
+func (s *Series) save() error {
+	contents, err := json.Marshal(s.progress)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(s.ProgressFile, contents, 0644)
+}
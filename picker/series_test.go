@@ -0,0 +1,99 @@
+package picker
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+func TestIdentify(t *testing.T) {
+	s := &Series{Folders: []string{"docs/"}}
+
+	tests := []struct {
+		name    string
+		video   videostorage.Video
+		series  string
+		season  int
+		episode int
+		ok      bool
+	}{
+		{"metadata", videostorage.Video{Key: "x.flv", Metadata: map[string]string{"series": "Show", "season": "2", "episode": "3"}}, "Show", 2, 3, true},
+		{"episode numbering", videostorage.Video{Key: "tv/My.Show.S01E02.flv"}, "tv/my.show", 1, 2, true},
+		{"series folder", videostorage.Video{Key: "docs/planet/part-1.flv"}, "docs/planet/", 0, 0, true},
+		{"too deep for a series folder", videostorage.Video{Key: "docs/planet/extras/a.flv"}, "", 0, 0, false},
+		{"not a series", videostorage.Video{Key: "movies/film.flv"}, "", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series, ep, ok := s.identify(tt.video)
+			if ok != tt.ok || series != tt.series || ep.Season != tt.season || ep.Episode != tt.episode {
+				t.Errorf("identify(%s) = %q S%dE%d %v, want %q S%dE%d %v", tt.video.Key, series, ep.Season, ep.Episode, ok,
+					tt.series, tt.season, tt.episode, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSeriesRuns(t *testing.T) {
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+	viper.Set("series.enabled", true)
+	viper.Set("series.run_length", 2)
+	viper.Set("series.progress_file", progressFile)
+	defer viper.Reset()
+
+	candidates := []videostorage.Video{
+		{Key: "tv/show.s01e03.flv"},
+		{Key: "tv/show.s01e01.flv"},
+		{Key: "tv/show.s01e02.flv"},
+		{Key: "movie.flv"},
+	}
+	// the wrapped picker always lands on the last episode, and then on the movie
+	landOn := "tv/show.s01e03.flv"
+	inner := pickerFunc(func(candidates []videostorage.Video) videostorage.Video {
+		for _, curr := range candidates {
+			if curr.Key == landOn {
+				return curr
+			}
+		}
+		return candidates[0]
+	})
+
+	s := SeriesFromConfig(inner)
+	play := func() string {
+		choice := s.Pick(candidates)
+		s.RecordPlay(choice)
+		return choice.Key
+	}
+
+	if got := play(); got != "tv/show.s01e01.flv" {
+		t.Fatalf("first pick = %s, want the first episode", got)
+	}
+	landOn = "movie.flv"
+	if got := play(); got != "tv/show.s01e02.flv" {
+		t.Fatalf("second pick = %s, want the run to carry on", got)
+	}
+	if got := play(); got != "movie.flv" {
+		t.Fatalf("third pick = %s, want the run to have ended", got)
+	}
+
+	// progress carries over to a new picker
+	landOn = "tv/show.s01e01.flv"
+	s = SeriesFromConfig(inner)
+	if got := play(); got != "tv/show.s01e03.flv" {
+		t.Fatalf("pick after restart = %s, want the third episode", got)
+	}
+	if got := play(); got != "tv/show.s01e01.flv" {
+		t.Fatalf("pick after the last episode = %s, want the series to start over", got)
+	}
+}
+
+// pickerFunc lets a plain function be used as a picker in tests
+type pickerFunc func(candidates []videostorage.Video) videostorage.Video
+
+func (f pickerFunc) Pick(candidates []videostorage.Video) videostorage.Video {
+	return f(candidates)
+}
@@ -0,0 +1,76 @@
+package queue
+
+import "sync"
+
+// Queue holds video keys that an operator has asked to play next. Queued videos are played in order ahead of any
+// randomly picked ones.
+type Queue struct {
+	sync.Mutex
+
+	keys []string
+}
+
+// Push adds a video to the end of the queue
+func (q *Queue) Push(key string) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.keys = append(q.keys, key)
+}
+
+// Pop removes and returns the video at the front of the queue. Returns false if the queue is empty.
+func (q *Queue) Pop() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.keys) == 0 {
+		return "", false
+	}
+
+	key := q.keys[0]
+	q.keys = q.keys[1:]
+	return key, true
+}
+
+// Peek returns the video at the front of the queue without removing it. Returns false if the queue is empty.
+func (q *Queue) Peek() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.keys) == 0 {
+		return "", false
+	}
+
+	return q.keys[0], true
+}
+
+// Remove deletes the video at the given position. Returns false if the position is out of range.
+func (q *Queue) Remove(idx int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if idx < 0 || idx >= len(q.keys) {
+		return false
+	}
+
+	q.keys = append(q.keys[:idx:idx], q.keys[idx+1:]...)
+	return true
+}
+
+// Clear empties the queue
+func (q *Queue) Clear() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.keys = nil
+}
+
+// List returns a copy of everything in the queue, front first
+func (q *Queue) List() []string {
+	q.Lock()
+	defer q.Unlock()
+
+	res := make([]string, len(q.keys))
+	copy(res, q.keys)
+	return res
+}
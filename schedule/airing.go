@@ -0,0 +1,201 @@
+package schedule
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	// defaultLateLimit is how late an airing may start (because the video before it ran long) before it is given up on
+	defaultLateLimit = 1 * time.Hour
+	// defaultFillWindow is how far ahead of an airing the picker starts looking for videos that will finish in time
+	defaultFillWindow = 3 * time.Hour
+)
+
+// Airing is a video that must play at a fixed time, either once (`At`) or every week on the given days at `Time`.
+// If `Preempt` is set, whatever is playing when the time arrives is cut off; otherwise the airing waits for the
+// current video to end.
+type Airing struct {
+	Key     string
+	Preempt bool
+
+	At   time.Time
+	Days map[time.Weekday]bool
+	Time time.Duration
+}
+
+// AiringOccurrence is a single scheduled play of an airing
+type AiringOccurrence struct {
+	Key     string    `json:"key"`
+	Start   time.Time `json:"start"`
+	Preempt bool      `json:"preempt"`
+
+	airing *Airing
+}
+
+type airingConfig struct {
+	Key     string   `mapstructure:"key"`
+	At      string   `mapstructure:"at"`
+	Days    []string `mapstructure:"days"`
+	Time    string   `mapstructure:"time"`
+	Preempt bool     `mapstructure:"preempt"`
+}
+
+// loadAirings reads `schedule.airings` from the config
+func loadAirings(location *time.Location) []*Airing {
+	var configs []airingConfig
+	if err := viper.UnmarshalKey("schedule.airings", &configs); err != nil {
+		log.WithError(err).Fatal("could not read scheduled airings config")
+	}
+
+	var res []*Airing
+	for _, curr := range configs {
+		logger := log.WithField("video", curr.Key)
+		if curr.Key == "" {
+			log.Fatal("scheduled airing is missing key")
+		}
+
+		airing := &Airing{
+			Key:     curr.Key,
+			Preempt: curr.Preempt,
+		}
+
+		if curr.At != "" {
+			at, err := time.ParseInLocation("2006-01-02T15:04", curr.At, location)
+			if err != nil {
+				at, err = time.Parse(time.RFC3339, curr.At)
+			}
+			if err != nil {
+				logger.WithField("at", curr.At).Fatal("scheduled airing time must look like 2006-01-02T15:04 or be RFC3339")
+			}
+			airing.At = at
+		} else {
+			clock, err := parseClock(curr.Time)
+			if err != nil {
+				logger.WithError(err).Fatal("scheduled airing needs either at or time")
+			}
+			airing.Time = clock
+			airing.Days = make(map[time.Weekday]bool)
+			for _, day := range curr.Days {
+				weekday, ok := weekdays[strings.ToLower(day)]
+				if !ok {
+					logger.WithField("day", day).Fatal("invalid day in scheduled airing")
+				}
+				airing.Days[weekday] = true
+			}
+			if len(airing.Days) == 0 {
+				for _, weekday := range weekdays {
+					airing.Days[weekday] = true
+				}
+			}
+		}
+
+		res = append(res, airing)
+	}
+
+	return res
+}
+
+// airingOccurrences lists every airing between `from` and `to`, soonest first
+func (s *Schedule) airingOccurrences(from time.Time, to time.Time) []AiringOccurrence {
+	from = from.In(s.Location)
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, s.Location)
+
+	var res []AiringOccurrence
+	for _, airing := range s.Airings {
+		if !airing.At.IsZero() {
+			if !airing.At.Before(from) && airing.At.Before(to) {
+				res = append(res, AiringOccurrence{airing.Key, airing.At.In(s.Location), airing.Preempt, airing})
+			}
+			continue
+		}
+
+		for day := midnight; day.Before(to); day = day.AddDate(0, 0, 1) {
+			start := s.onDay(day, airing.Time)
+			if airing.Days[day.Weekday()] && !start.Before(from) && start.Before(to) {
+				res = append(res, AiringOccurrence{airing.Key, start, airing.Preempt, airing})
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+
+	return res
+}
+
+// DueAiring returns an airing whose time has come and which hasn't been played yet. Airings more than the late limit
+// past their start are given up on.
+func (s *Schedule) DueAiring(now time.Time) *AiringOccurrence {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, curr := range s.airingOccurrences(now.Add(-s.LateLimit), now.Add(time.Nanosecond)) {
+		if aired, ok := s.aired[curr.airing]; ok && !aired.Before(curr.Start) {
+			continue
+		}
+		return &curr
+	}
+	return nil
+}
+
+// MarkAired records that an airing has been played (or attempted) so it isn't played again
+func (s *Schedule) MarkAired(occurrence *AiringOccurrence) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.aired[occurrence.airing] = occurrence.Start
+}
+
+// NextAiring returns the first airing starting after `now`, or nil if there isn't one in the next week. If
+// `preemptOnly` is set, only airings that cut off the current video are considered.
+func (s *Schedule) NextAiring(now time.Time, preemptOnly bool) *AiringOccurrence {
+	for _, curr := range s.airingOccurrences(now.Add(time.Nanosecond), now.Add(upcomingWindow)) {
+		if !preemptOnly || curr.Preempt {
+			return &curr
+		}
+	}
+	return nil
+}
+
+// UpcomingAirings returns every airing in the next week, soonest first
+func (s *Schedule) UpcomingAirings(now time.Time) []AiringOccurrence {
+	res := make([]AiringOccurrence, 0)
+	return append(res, s.airingOccurrences(now, now.Add(upcomingWindow))...)
+}
+
+// pickFiller looks for a video matching `match` that will finish before the next airing, if the next airing is close
+// enough for that to matter. Only videos with a known duration are considered.
+func (s *Schedule) pickFiller(storage videostorage.Storage, now time.Time, match func(videostorage.Video) bool) (string, bool) {
+	next := s.NextAiring(now, false)
+	if next == nil || next.Start.Sub(now) > s.FillWindow {
+		return "", false
+	}
+
+	remaining := next.Start.Sub(now)
+	video, ok := storage.ChooseVideo(func(v videostorage.Video) bool {
+		duration := time.Duration(v.DurationSeconds * float64(time.Second))
+		return duration > 0 && duration <= remaining && match(v)
+	})
+	if !ok {
+		log.WithFields(log.Fields{
+			"airing":    next.Key,
+			"remaining": remaining.String(),
+		}).Warn("no video with a known duration fits before the next airing")
+		return "", false
+	}
+
+	log.WithFields(log.Fields{
+		"video":     video.Key,
+		"airing":    next.Key,
+		"remaining": remaining.String(),
+	}).Info("picked filler that fits before the next airing")
+	return video.Key, true
+}
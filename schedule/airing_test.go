@@ -0,0 +1,43 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAiringOccurrencesAcrossClockChanges(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Schedule{
+		Location: location,
+		Airings: []*Airing{
+			{Key: "news.flv", Days: everyDay(), Time: 20 * time.Hour},
+		},
+	}
+
+	tests := []struct {
+		name string
+		day  time.Time
+	}{
+		{"normal day", time.Date(2026, 3, 4, 0, 0, 0, 0, location)},
+		{"clocks go forward", time.Date(2026, 3, 8, 0, 0, 0, 0, location)},
+		{"clocks go back", time.Date(2026, 11, 1, 0, 0, 0, 0, location)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.airingOccurrences(tt.day, tt.day.AddDate(0, 0, 1))
+			if len(got) != 1 {
+				t.Fatalf("got %d airings, want 1", len(got))
+			}
+
+			want := time.Date(tt.day.Year(), tt.day.Month(), tt.day.Day(), 20, 0, 0, 0, location)
+			if !got[0].Start.Equal(want) {
+				t.Errorf("airing starts at %s, want %s", got[0].Start, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package schedule
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultBreakFolder = "breaks/"
+
+// Break is a weekly slot for interstitials. Once its time arrives, `Count` clips from `Folder` in the interstitial
+// pool play as soon as the current video ends.
+type Break struct {
+	Days   map[time.Weekday]bool
+	Time   time.Duration
+	Folder string
+	Count  int
+}
+
+// BreakOccurrence is a single scheduled run of a break
+type BreakOccurrence struct {
+	Start  time.Time `json:"start"`
+	Folder string    `json:"folder"`
+	Count  int       `json:"count"`
+
+	brk *Break
+}
+
+type breakConfig struct {
+	Days   []string `mapstructure:"days"`
+	Time   string   `mapstructure:"time"`
+	Folder string   `mapstructure:"folder"`
+	Count  int      `mapstructure:"count"`
+}
+
+// loadBreaks reads `schedule.breaks` from the config
+func loadBreaks() []*Break {
+	var configs []breakConfig
+	if err := viper.UnmarshalKey("schedule.breaks", &configs); err != nil {
+		log.WithError(err).Fatal("could not read scheduled breaks config")
+	}
+
+	var res []*Break
+	for _, curr := range configs {
+		clock, err := parseClock(curr.Time)
+		if err != nil {
+			log.WithError(err).Fatal("invalid scheduled break time")
+		}
+
+		brk := &Break{
+			Days:   make(map[time.Weekday]bool),
+			Time:   clock,
+			Folder: curr.Folder,
+			Count:  curr.Count,
+		}
+		if brk.Folder == "" {
+			brk.Folder = defaultBreakFolder
+		}
+		if brk.Count <= 0 {
+			brk.Count = 1
+		}
+
+		for _, day := range curr.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				log.WithField("day", day).Fatal("invalid day in scheduled break")
+			}
+			brk.Days[weekday] = true
+		}
+		if len(brk.Days) == 0 {
+			for _, weekday := range weekdays {
+				brk.Days[weekday] = true
+			}
+		}
+
+		res = append(res, brk)
+	}
+
+	return res
+}
+
+// breakOccurrences lists every break between `from` and `to`, soonest first
+func (s *Schedule) breakOccurrences(from time.Time, to time.Time) []BreakOccurrence {
+	from = from.In(s.Location)
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, s.Location)
+
+	var res []BreakOccurrence
+	for _, brk := range s.Breaks {
+		for day := midnight; day.Before(to); day = day.AddDate(0, 0, 1) {
+			start := s.onDay(day, brk.Time)
+			if brk.Days[day.Weekday()] && !start.Before(from) && start.Before(to) {
+				res = append(res, BreakOccurrence{start, brk.Folder, brk.Count, brk})
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+
+	return res
+}
+
+// TakeBreak returns a break whose time has come and which hasn't run yet, marking it as run. Like airings, breaks more
+// than the late limit past their start are given up on.
+func (s *Schedule) TakeBreak(now time.Time) *BreakOccurrence {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, curr := range s.breakOccurrences(now.Add(-s.LateLimit), now.Add(time.Nanosecond)) {
+		if taken, ok := s.breaksTaken[curr.brk]; ok && !taken.Before(curr.Start) {
+			continue
+		}
+		s.breaksTaken[curr.brk] = curr.Start
+		return &curr
+	}
+	return nil
+}
+
+// UpcomingBreaks returns every break in the next week, soonest first
+func (s *Schedule) UpcomingBreaks(now time.Time) []BreakOccurrence {
+	res := make([]BreakOccurrence, 0)
+	return append(res, s.breakOccurrences(now, now.Add(upcomingWindow))...)
+}
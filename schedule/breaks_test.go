@@ -0,0 +1,45 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeBreak(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Schedule{
+		Location:    location,
+		LateLimit:   time.Hour,
+		Breaks:      []*Break{{Days: everyDay(), Time: 18 * time.Hour, Folder: "breaks/", Count: 2}},
+		breaksTaken: make(map[*Break]time.Time),
+	}
+
+	// the clocks go forward on this day, which mustn't move the break
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"before the break", time.Date(2026, 3, 8, 17, 59, 0, 0, location), false},
+		{"at the break", time.Date(2026, 3, 8, 18, 0, 0, 0, location), true},
+		{"already taken", time.Date(2026, 3, 8, 18, 5, 0, 0, location), false},
+		{"too late for the next day's break", time.Date(2026, 3, 9, 19, 30, 0, 0, location), false},
+		{"on time the day after", time.Date(2026, 3, 10, 18, 30, 0, 0, location), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.TakeBreak(tt.at)
+			if (got != nil) != tt.want {
+				t.Fatalf("TakeBreak(%s) = %v, want a break: %v", tt.at, got, tt.want)
+			}
+			if got != nil && got.Count != 2 {
+				t.Errorf("break has count %d, want 2", got.Count)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+// upcomingWindow is how far ahead Upcoming looks for block occurrences
+const upcomingWindow = 7 * 24 * time.Hour
+
+// Block is a recurring slot in the programming schedule. During a block, videos are drawn from its playlist in order if
+// it has one, otherwise at random from videos under any of its prefixes that have any of its tags.
+type Block struct {
+	Name     string
+	Days     map[time.Weekday]bool
+	Start    time.Duration
+	End      time.Duration
+	Prefixes []string
+	Tags     []string
+	Playlist []string
+
+	playlistPos int
+}
+
+// Matches reports whether a video belongs in this block
+func (b *Block) Matches(v videostorage.Video) bool {
+	return b.matchesPrefix(v) && b.matchesTags(v)
+}
+
+func (b *Block) matchesPrefix(v videostorage.Video) bool {
+	if len(b.Prefixes) == 0 {
+		return true
+	}
+
+	for _, curr := range b.Prefixes {
+		if strings.HasPrefix(v.Key, curr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTags checks the tags given to the video by the manifest
+func (b *Block) matchesTags(v videostorage.Video) bool {
+	if len(b.Tags) == 0 {
+		return true
+	}
+
+	for _, want := range b.Tags {
+		for _, have := range v.Tags {
+			if strings.EqualFold(want, have) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Occurrence is a single airing of a block
+type Occurrence struct {
+	Block string    `json:"block"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	block *Block
+}
+
+// Schedule maps times of the week to blocks, and holds airings of specific videos at fixed times. Blocks are weekly
+// and in the schedule's time zone. If blocks overlap, the one listed first in the config wins.
+type Schedule struct {
+	sync.Mutex
+
+	Location *time.Location
+	Blocks   []*Block
+	Airings  []*Airing
+	Breaks   []*Break
+
+	LateLimit  time.Duration
+	FillWindow time.Duration
+
+	aired       map[*Airing]time.Time
+	breaksTaken map[*Break]time.Time
+}
+
+type blockConfig struct {
+	Name     string   `mapstructure:"name"`
+	Days     []string `mapstructure:"days"`
+	Start    string   `mapstructure:"start"`
+	End      string   `mapstructure:"end"`
+	Prefixes []string `mapstructure:"prefixes"`
+	Tags     []string `mapstructure:"tags"`
+	Playlist []string `mapstructure:"playlist"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parseClock parses a time of day like `06:30` in to the offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// onDay returns the wall clock time `clock` after midnight on `day` in the schedule's time zone. Unlike adding the
+// offset to midnight, this stays right on days when the clocks change.
+func (s *Schedule) onDay(day time.Time, clock time.Duration) time.Time {
+	day = day.In(s.Location)
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, s.Location)
+}
+
+// FromConfig reads the `schedule` section of the config. Returns nil if no blocks, airings or breaks are configured.
+func FromConfig() *Schedule {
+	var configs []blockConfig
+	if err := viper.UnmarshalKey("schedule.blocks", &configs); err != nil {
+		log.WithError(err).Fatal("could not read schedule config")
+	}
+	if len(configs) == 0 && !viper.IsSet("schedule.airings") && !viper.IsSet("schedule.breaks") {
+		return nil
+	}
+
+	location := time.Local
+	if tz := viper.GetString("schedule.timezone"); tz != "" {
+		var err error
+		location, err = time.LoadLocation(tz)
+		if err != nil {
+			log.WithError(err).WithField("timezone", tz).Fatal("could not load schedule timezone")
+		}
+	}
+
+	s := &Schedule{
+		Location:    location,
+		LateLimit:   defaultLateLimit,
+		FillWindow:  defaultFillWindow,
+		aired:       make(map[*Airing]time.Time),
+		breaksTaken: make(map[*Break]time.Time),
+	}
+	if lateLimit := viper.GetInt("schedule.late_limit_minutes"); lateLimit != 0 {
+		s.LateLimit = time.Duration(lateLimit) * time.Minute
+	}
+	if fillWindow := viper.GetInt("schedule.fill_window_minutes"); fillWindow != 0 {
+		s.FillWindow = time.Duration(fillWindow) * time.Minute
+	}
+
+	for _, curr := range configs {
+		logger := log.WithField("block", curr.Name)
+
+		start, err := parseClock(curr.Start)
+		if err != nil {
+			logger.WithError(err).Fatal("invalid schedule block start")
+		}
+		end, err := parseClock(curr.End)
+		if err != nil {
+			logger.WithError(err).Fatal("invalid schedule block end")
+		}
+
+		days := make(map[time.Weekday]bool)
+		for _, day := range curr.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				logger.WithField("day", day).Fatal("invalid day in schedule block")
+			}
+			days[weekday] = true
+		}
+		if len(days) == 0 {
+			for _, weekday := range weekdays {
+				days[weekday] = true
+			}
+		}
+
+		s.Blocks = append(s.Blocks, &Block{
+			Name:     curr.Name,
+			Days:     days,
+			Start:    start,
+			End:      end,
+			Prefixes: curr.Prefixes,
+			Tags:     curr.Tags,
+			Playlist: curr.Playlist,
+		})
+	}
+
+	s.Airings = loadAirings(location)
+	s.Breaks = loadBreaks()
+
+	log.WithFields(log.Fields{
+		"blocks":   len(s.Blocks),
+		"airings":  len(s.Airings),
+		"breaks":   len(s.Breaks),
+		"timezone": location.String(),
+	}).Info("loaded programming schedule")
+
+	return s
+}
+
+// occurrences lists every airing of every block that overlaps the window from `from` to `to`, ordered by start time.
+// Blocks that end at or before their start time run past midnight in to the next day.
+func (s *Schedule) occurrences(from time.Time, to time.Time) []Occurrence {
+	from = from.In(s.Location)
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, s.Location)
+
+	var res []Occurrence
+	// start a day early to catch blocks that began yesterday and run past midnight
+	for day := midnight.AddDate(0, 0, -1); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, block := range s.Blocks {
+			if !block.Days[day.Weekday()] {
+				continue
+			}
+
+			start := s.onDay(day, block.Start)
+			end := s.onDay(day, block.End)
+			if !end.After(start) {
+				end = s.onDay(day.AddDate(0, 0, 1), block.End)
+			}
+
+			if end.After(from) && start.Before(to) {
+				res = append(res, Occurrence{
+					Block: block.Name,
+					Start: start,
+					End:   end,
+					block: block,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+
+	return res
+}
+
+// Current returns the block airing at the given time, or nil if nothing is scheduled
+func (s *Schedule) Current(now time.Time) *Occurrence {
+	airing := s.occurrences(now, now.Add(time.Nanosecond))
+	for _, block := range s.Blocks {
+		for _, curr := range airing {
+			if curr.block == block && !now.Before(curr.Start) {
+				return &curr
+			}
+		}
+	}
+	return nil
+}
+
+// Upcoming returns the blocks starting after `now` within the next week, soonest first
+func (s *Schedule) Upcoming(now time.Time) []Occurrence {
+	res := make([]Occurrence, 0)
+	for _, curr := range s.occurrences(now, now.Add(upcomingWindow)) {
+		if curr.Start.After(now) {
+			res = append(res, curr)
+		}
+	}
+	return res
+}
+
+// Peek chooses the next video according to the schedule, without committing to it. A block with a playlist plays it
+// in order. Otherwise, if an airing is coming up soon, a video that will finish before it is preferred, and failing
+// that a random video from the current block is picked. Returns false if the schedule has no opinion, in which case
+// the caller should fall back to picking from the whole library. Playlists only move on once Played is called.
+func (s *Schedule) Peek(storage videostorage.Storage, now time.Time) (string, bool) {
+	match := func(videostorage.Video) bool { return true }
+
+	current := s.Current(now)
+	if current != nil {
+		if len(current.block.Playlist) > 0 {
+			if key, _, ok := s.peekPlaylist(storage, current.block); ok {
+				return key, true
+			}
+		}
+		match = current.block.Matches
+	}
+
+	if key, ok := s.pickFiller(storage, now, match); ok {
+		return key, true
+	}
+
+	if current == nil {
+		return "", false
+	}
+
+	logger := log.WithField("block", current.Block)
+	video, ok := storage.ChooseVideo(match)
+	if !ok {
+		logger.WithField("prefixes", current.block.Prefixes).Warn("no videos match this block")
+		return "", false
+	}
+
+	logger.WithField("video", video.Key).Info("picked video for block")
+	return video.Key, true
+}
+
+// Played tells the schedule that `key` has started playing. If it is the next video in the current block's playlist,
+// the playlist moves on past it.
+func (s *Schedule) Played(storage videostorage.Storage, key string, now time.Time) {
+	current := s.Current(now)
+	if current == nil || len(current.block.Playlist) == 0 {
+		return
+	}
+
+	next, pos, ok := s.peekPlaylist(storage, current.block)
+	if !ok || next != key {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	current.block.playlistPos = (pos + 1) % len(current.block.Playlist)
+}
+
+// peekPlaylist finds the next video in the block's playlist from where it left off, skipping anything that's gone
+// missing from storage. Returns the video and its position in the playlist.
+func (s *Schedule) peekPlaylist(storage videostorage.Storage, block *Block) (string, int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	logger := log.WithField("block", block.Name)
+	for i := 0; i < len(block.Playlist); i++ {
+		pos := (block.playlistPos + i) % len(block.Playlist)
+		key := block.Playlist[pos]
+
+		if storage.HasVideo(key) {
+			logger.WithField("video", key).Debug("found next video in block playlist")
+			return key, pos, true
+		}
+		logger.WithField("video", key).Warn("skipping unknown video in block playlist")
+	}
+
+	logger.Warn("no playlist videos in this block are available")
+	return "", 0, false
+}
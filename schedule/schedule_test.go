@@ -0,0 +1,87 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func everyDay() map[time.Weekday]bool {
+	days := make(map[time.Weekday]bool)
+	for _, curr := range weekdays {
+		days[curr] = true
+	}
+	return days
+}
+
+func TestCurrent(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Schedule{
+		Location: location,
+		Blocks: []*Block{
+			{Name: "morning", Days: everyDay(), Start: 6 * time.Hour, End: 9 * time.Hour},
+			{Name: "late", Days: everyDay(), Start: 22 * time.Hour, End: 4 * time.Hour},
+		},
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want string
+	}{
+		{"morning block", time.Date(2026, 3, 4, 6, 30, 0, 0, location), "morning"},
+		{"after morning block", time.Date(2026, 3, 4, 9, 0, 0, 0, location), ""},
+		{"clocks go forward", time.Date(2026, 3, 8, 6, 30, 0, 0, location), "morning"},
+		{"before block when clocks go forward", time.Date(2026, 3, 8, 5, 30, 0, 0, location), ""},
+		{"clocks go back", time.Date(2026, 11, 1, 8, 30, 0, 0, location), "morning"},
+		{"after block when clocks go back", time.Date(2026, 11, 1, 9, 30, 0, 0, location), ""},
+		{"late block before midnight", time.Date(2026, 3, 4, 23, 0, 0, 0, location), "late"},
+		{"late block after midnight", time.Date(2026, 3, 5, 2, 0, 0, 0, location), "late"},
+		{"after late block", time.Date(2026, 3, 5, 4, 0, 0, 0, location), ""},
+		{"late block over clocks going forward", time.Date(2026, 3, 8, 3, 30, 0, 0, location), "late"},
+		{"after late block when clocks go forward", time.Date(2026, 3, 8, 4, 30, 0, 0, location), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if curr := s.Current(tt.at); curr != nil {
+				got = curr.Block
+			}
+			if got != tt.want {
+				t.Errorf("Current(%s) = %q, want %q", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOccurrencesRunPastMidnight(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Schedule{
+		Location: location,
+		Blocks: []*Block{
+			{Name: "late", Days: map[time.Weekday]bool{time.Saturday: true}, Start: 22 * time.Hour, End: 4 * time.Hour},
+		},
+	}
+
+	// saturday night in to the sunday the clocks go forward
+	from := time.Date(2026, 3, 7, 12, 0, 0, 0, location)
+	got := s.occurrences(from, from.Add(24*time.Hour))
+	if len(got) != 1 {
+		t.Fatalf("got %d occurrences, want 1", len(got))
+	}
+
+	wantStart := time.Date(2026, 3, 7, 22, 0, 0, 0, location)
+	wantEnd := time.Date(2026, 3, 8, 4, 0, 0, 0, location)
+	if !got[0].Start.Equal(wantStart) || !got[0].End.Equal(wantEnd) {
+		t.Errorf("got %s to %s, want %s to %s", got[0].Start, got[0].End, wantStart, wantEnd)
+	}
+}
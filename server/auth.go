@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ScopeRead allows access to endpoints that only report on state
+	ScopeRead = "read"
+	// ScopeControl allows access to everything, including endpoints that change what is playing
+	ScopeControl = "control"
+)
+
+// apiKey is a named key from the `api.keys` config list
+type apiKey struct {
+	Name  string `mapstructure:"name"`
+	Key   string `mapstructure:"key"`
+	Scope string `mapstructure:"scope"`
+}
+
+func (k apiKey) allows(scope string) bool {
+	return k.Scope == ScopeControl || k.Scope == scope
+}
+
+// loadApiKeys reads the API keys from config. Keys without a scope default to read only.
+func loadApiKeys() []apiKey {
+	var keys []apiKey
+	if err := viper.UnmarshalKey("api.keys", &keys); err != nil {
+		log.WithError(err).Fatal("could not read api keys from config")
+	}
+
+	for i := range keys {
+		if keys[i].Key == "" {
+			log.WithField("name", keys[i].Name).Fatal("api key is blank")
+		}
+		if keys[i].Scope == "" {
+			keys[i].Scope = ScopeRead
+		}
+		if keys[i].Scope != ScopeRead && keys[i].Scope != ScopeControl {
+			log.WithFields(log.Fields{
+				"name":  keys[i].Name,
+				"scope": keys[i].Scope,
+			}).Fatal("api key scope must be read or control")
+		}
+	}
+
+	return keys
+}
+
+// requestToken pulls the API key out of an `Authorization: Bearer` header, an `X-API-Key` header or, for clients like
+// browser EventSources that can't set headers, an `api_key` query parameter
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+
+	return c.Query("api_key")
+}
+
+// requireScope builds middleware that rejects requests that don't carry a key with the given scope. Every key is
+// compared in constant time, and all of them are checked regardless of whether an earlier one matched, so response
+// timing doesn't leak anything about the keys. If no keys are configured, every request is refused unless `open` is
+// set, in which case every request is let through.
+func requireScope(keys []apiKey, scope string, open bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(keys) == 0 && open {
+			c.Next()
+			return
+		}
+
+		token := []byte(requestToken(c))
+
+		var matched *apiKey
+		for i := range keys {
+			if subtle.ConstantTimeCompare(token, []byte(keys[i].Key)) == 1 {
+				matched = &keys[i]
+			}
+		}
+
+		if matched == nil {
+			c.AbortWithStatusJSON(401, gin.H{
+				"message": "missing or invalid api key",
+			})
+			return
+		}
+
+		if !matched.allows(scope) {
+			log.WithFields(log.Fields{
+				"name":  matched.Name,
+				"path":  c.FullPath(),
+				"scope": scope,
+			}).Warn("api key does not have required scope")
+			c.AbortWithStatusJSON(403, gin.H{
+				"message": "api key does not have the required scope",
+			})
+			return
+		}
+
+		c.Set("api_key_name", matched.Name)
+		c.Next()
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := []apiKey{
+		{Name: "reader", Key: "read-key", Scope: ScopeRead},
+		{Name: "operator", Key: "control-key", Scope: ScopeControl},
+	}
+
+	tests := []struct {
+		name  string
+		keys  []apiKey
+		open  bool
+		scope string
+		token string
+		want  int
+	}{
+		{"no keys configured", nil, false, ScopeRead, "", 401},
+		{"no keys configured but left open", nil, true, ScopeControl, "", 200},
+		{"open is ignored once there are keys", keys, true, ScopeRead, "", 401},
+		{"missing key", keys, false, ScopeRead, "", 401},
+		{"wrong key", keys, false, ScopeRead, "nope", 401},
+		{"read key reading", keys, false, ScopeRead, "read-key", 200},
+		{"read key controlling", keys, false, ScopeControl, "read-key", 403},
+		{"control key reading", keys, false, ScopeRead, "control-key", 200},
+		{"control key controlling", keys, false, ScopeControl, "control-key", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", requireScope(tt.keys, tt.scope, tt.open), func(c *gin.Context) {
+				c.Status(200)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			res := httptest.NewRecorder()
+			r.ServeHTTP(res, req)
+
+			if res.Code != tt.want {
+				t.Errorf("got status %d, want %d", res.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// dashboardFiles holds the operator dashboard, a single page app that talks to the same API as everything else. The
+// page itself is public; it asks for an API key and sends it with every request.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func registerDashboard(r *gin.Engine) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		log.WithError(err).Fatal("could not load embedded dashboard")
+	}
+
+	r.StaticFS("/dashboard", http.FS(files))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
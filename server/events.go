@@ -0,0 +1,52 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lthummus/bucket-stream/notifier"
+)
+
+const sseKeepAlivePeriod = 15 * time.Second
+
+// streamEvents serves the event bus as Server-Sent Events. Each SSE event is named after the event type and carries
+// the event as JSON. Clients can pass `types` as a comma separated list to only receive some event types.
+func (s *Server) streamEvents(c *gin.Context) {
+	wanted := make(map[notifier.EventType]bool)
+	if types := c.Query("types"); types != "" {
+		for _, curr := range strings.Split(types, ",") {
+			wanted[notifier.EventType(strings.TrimSpace(curr))] = true
+		}
+	}
+
+	events, unsubscribe := s.Events.Subscribe(100)
+	defer unsubscribe()
+
+	keepAlive := time.NewTicker(sseKeepAlivePeriod)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			// an SSE comment, which clients ignore, keeps proxies from timing out an idle connection
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if len(wanted) == 0 || wanted[event.Type] {
+				c.SSEvent(string(event.Type), event)
+			}
+			return true
+		}
+	})
+}
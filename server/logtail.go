@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogLine is a single captured log entry. Seq increases by one for every entry, so clients can ask for everything after
+// the last line they saw.
+type LogLine struct {
+	Seq     int64             `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// LogTail is a logrus hook that keeps the most recent log entries in memory for the dashboard
+type LogTail struct {
+	sync.Mutex
+
+	size    int
+	lines   []LogLine
+	seq     int64
+	secrets []string
+}
+
+var _ log.Hook = &LogTail{}
+
+// NewLogTail builds a log tail that remembers the last `size` entries. Install it with `log.AddHook`.
+func NewLogTail(size int) *LogTail {
+	return &LogTail{
+		size: size,
+	}
+}
+
+// Redact hides every given secret (like the stream key) in anything captured from now on. Empty strings are ignored.
+func (t *LogTail) Redact(secrets ...string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, curr := range secrets {
+		if curr != "" {
+			t.secrets = append(t.secrets, curr)
+		}
+	}
+}
+
+// redact must be called with the lock held
+func (t *LogTail) redact(s string) string {
+	for _, curr := range t.secrets {
+		s = strings.ReplaceAll(s, curr, "<redacted>")
+	}
+	return s
+}
+
+func (t *LogTail) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (t *LogTail) Fire(entry *log.Entry) error {
+	t.Lock()
+	defer t.Unlock()
+
+	fields := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = t.redact(fmt.Sprint(v))
+	}
+
+	t.seq++
+	t.lines = append(t.lines, LogLine{
+		Seq:     t.seq,
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: t.redact(entry.Message),
+		Fields:  fields,
+	})
+	if len(t.lines) > t.size {
+		t.lines = t.lines[len(t.lines)-t.size:]
+	}
+
+	return nil
+}
+
+// Since returns every remembered entry with a sequence number greater than `seq`, oldest first
+func (t *LogTail) Since(seq int64) []LogLine {
+	t.Lock()
+	defer t.Unlock()
+
+	res := make([]LogLine, 0)
+	for _, curr := range t.lines {
+		if curr.Seq > seq {
+			res = append(res, curr)
+		}
+	}
+	return res
+}
+
+// serveLogs returns the remembered log entries after the `after` sequence number
+func (s *Server) serveLogs(c *gin.Context) {
+	if s.Logs == nil {
+		c.JSON(404, gin.H{
+			"message": "log tail not configured",
+		})
+		return
+	}
+
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"message": "after must be a number",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"lines": s.Logs.Since(after),
+	})
+}
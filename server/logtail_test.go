@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogsNeverReturnStreamKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const (
+		endpoint  = "rtmp://live.twitch.tv/app/live_123456_secretsecret"
+		streamKey = "live_123456_secretsecret"
+	)
+
+	tail := NewLogTail(10)
+	tail.Redact(endpoint, streamKey)
+
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.AddHook(tail)
+	logger.Warn("[flv @ 0x55d] Failed to update header with correct duration. " + endpoint + ": Broken pipe")
+	logger.WithField("endpoint", endpoint).Info("connecting")
+	logger.Error("key " + streamKey + " was rejected")
+
+	s := &Server{Logs: tail}
+	r := gin.New()
+	r.GET("/logs", s.serveLogs)
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/logs", nil))
+
+	if res.Code != 200 {
+		t.Fatalf("got status %d, want 200", res.Code)
+	}
+	body := res.Body.String()
+	if strings.Contains(body, streamKey) {
+		t.Errorf("/logs returned the stream key: %s", body)
+	}
+
+	var payload struct {
+		Lines []LogLine `json:"lines"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(payload.Lines))
+	}
+	if want := "[flv @ 0x55d] Failed to update header with correct duration. <redacted>: Broken pipe"; payload.Lines[0].Message != want {
+		t.Errorf("first line = %q, want %q", payload.Lines[0].Message, want)
+	}
+	if got := payload.Lines[1].Fields["endpoint"]; got != "<redacted>" {
+		t.Errorf("endpoint field = %q, want it redacted", got)
+	}
+}
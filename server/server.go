@@ -1,13 +1,23 @@
 package server
 
 import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/toorop/gin-logrus"
 
+	"github.com/lthummus/bucket-stream/eventbus"
+	"github.com/lthummus/bucket-stream/notifier"
+	"github.com/lthummus/bucket-stream/queue"
+	"github.com/lthummus/bucket-stream/schedule"
 	"github.com/lthummus/bucket-stream/streamer"
 	"github.com/lthummus/bucket-stream/videostorage"
 )
@@ -18,12 +28,22 @@ type Server struct {
 	Storage  videostorage.Storage
 	Streamer *streamer.Streamer
 
-	shouldContinue bool
-	start          time.Time
+	DeadLetters *notifier.DeadLetterLog
+	Events      *eventbus.Bus
+	Queue       *queue.Queue
+	Schedule    *schedule.Schedule
+	Logs        *LogTail
+
+	// stopRequested is the inverse of ShouldContinue so the zero value means keep going, even if a shutdown is
+	// requested before the server has started
+	stopRequested bool
+	paused        bool
+	upNext        string
+	start         time.Time
+	httpServer    *http.Server
 }
 
 func (s *Server) StartServer() {
-	s.shouldContinue = true
 	s.start = time.Now()
 
 	log.Info("initializing web server")
@@ -37,34 +57,221 @@ func (s *Server) StartServer() {
 	r := gin.New()
 	r.Use(ginlogrus.Logger(ginLogger), gin.Recovery())
 
-	r.GET("/ping", func(c *gin.Context) {
+	keys := loadApiKeys()
+	open := len(keys) == 0 && viper.GetBool("api.allow_unauthenticated")
+	if open {
+		log.Warn("no api keys configured and api.allow_unauthenticated is set, the control api is open to anyone who can reach it")
+	} else if len(keys) == 0 {
+		log.Error("no api keys configured, so every api request will be refused. add some to api.keys, or set api.allow_unauthenticated to leave the api open")
+	}
+
+	publicPing := true
+	if viper.IsSet("api.public_ping") {
+		publicPing = viper.GetBool("api.public_ping")
+	}
+
+	registerDashboard(r)
+
+	read := r.Group("/", requireScope(keys, ScopeRead, open))
+	control := r.Group("/", requireScope(keys, ScopeControl, open))
+
+	ping := func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "ok",
 		})
-	})
-	r.PUT("/continue/no", func(c *gin.Context) {
+	}
+	if publicPing {
+		r.GET("/ping", ping)
+	} else {
+		read.GET("/ping", ping)
+	}
+	control.PUT("/continue/no", func(c *gin.Context) {
 		s.SetContinue(false)
+		s.Events.Publish(notifier.Event{
+			Type: notifier.EventShutdownRequested,
+		})
+		// the standby slate never finishes on its own, so end it now
+		if s.Streamer.InStandby() {
+			s.Streamer.Skip()
+		}
 		c.JSON(200, gin.H{
 			"message": "ok",
 		})
 	})
-	r.PUT("/continue/yes", func(c *gin.Context) {
+	control.PUT("/continue/yes", func(c *gin.Context) {
 		s.SetContinue(true)
 		c.JSON(200, gin.H{
 			"message": "ok",
 		})
 	})
-	r.GET("/stats", func(c *gin.Context) {
-		c.JSON(200, gin.H{
+	read.GET("/stats", func(c *gin.Context) {
+		upNext := s.comingUp()
+		currentVideo := s.Streamer.GetVideo()
+		stats := gin.H{
 			"total_uptime":           time.Since(s.start).String(),
+			"start":                  s.start,
 			"should_continue":        s.ShouldContinue(),
+			"paused":                 s.IsPaused(),
+			"standby":                s.Streamer.InStandby(),
+			"interstitial":           s.Streamer.GetInterstitial(),
 			"video_count":            s.Storage.GetVideoCount(),
-			"currently_playing":      s.Streamer.GetVideo(),
+			"currently_playing":      currentVideo,
+			"video_start":            s.Streamer.VideoStart,
 			"time_since_video_start": time.Since(s.Streamer.VideoStart).String(),
 			"videos_played":          s.Streamer.PlayCount,
+			"up_next":                upNext,
+		}
+		if video, ok := s.Storage.GetVideoInfo(currentVideo); ok && video.DurationSeconds > 0 {
+			stats["duration_seconds"] = video.DurationSeconds
+			stats["remaining_seconds"] = math.Max(0, video.DurationSeconds-time.Since(s.Streamer.VideoStart).Seconds())
+		}
+		if cache, ok := s.Storage.(interface {
+			CacheStats() videostorage.CacheStats
+		}); ok {
+			stats["cache"] = cache.CacheStats()
+		}
+		c.JSON(200, stats)
+	})
+	read.GET("/events", s.streamEvents)
+	read.GET("/videos", s.listVideos)
+	read.GET("/videos/details", s.videoDetails)
+	read.GET("/videos/folders", s.listFolders)
+	read.GET("/videos/invalid", s.listInvalid)
+	read.GET("/schedule", func(c *gin.Context) {
+		if s.Schedule == nil {
+			c.JSON(404, gin.H{
+				"message": "no schedule configured",
+			})
+			return
+		}
+
+		now := time.Now()
+		c.JSON(200, gin.H{
+			"timezone": s.Schedule.Location.String(),
+			"now":      now.In(s.Schedule.Location),
+			"current":  s.Schedule.Current(now),
+			"upcoming": s.Schedule.Upcoming(now),
+			"airings":  s.Schedule.UpcomingAirings(now),
+			"breaks":   s.Schedule.UpcomingBreaks(now),
+		})
+	})
+	read.GET("/history", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"history": s.Streamer.GetHistory(),
+		})
+	})
+	read.GET("/logs", s.serveLogs)
+	read.GET("/queue", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"queue": s.Queue.List(),
 		})
 	})
-	r.POST("/enumerate", func(c *gin.Context) {
+	control.POST("/queue", func(c *gin.Context) {
+		var req struct {
+			Key string `json:"key" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{
+				"message": "key is required",
+			})
+			return
+		}
+
+		if !s.Storage.HasVideo(req.Key) {
+			c.JSON(404, gin.H{
+				"message": "unknown video",
+			})
+			return
+		}
+
+		s.Queue.Push(req.Key)
+		s.publishQueueChanged()
+		c.JSON(200, gin.H{
+			"message": "ok",
+			"queue":   s.Queue.List(),
+		})
+	})
+	control.DELETE("/queue/:index", func(c *gin.Context) {
+		idx, err := strconv.Atoi(c.Param("index"))
+		if err != nil || !s.Queue.Remove(idx) {
+			c.JSON(404, gin.H{
+				"message": "no such queue entry",
+			})
+			return
+		}
+		s.publishQueueChanged()
+
+		c.JSON(200, gin.H{
+			"message": "ok",
+			"queue":   s.Queue.List(),
+		})
+	})
+	control.DELETE("/queue", func(c *gin.Context) {
+		s.Queue.Clear()
+		s.publishQueueChanged()
+		c.JSON(200, gin.H{
+			"message": "ok",
+			"queue":   s.Queue.List(),
+		})
+	})
+	control.POST("/pause", func(c *gin.Context) {
+		mode := c.DefaultQuery("mode", "finish")
+		if mode != "finish" && mode != "interrupt" {
+			c.JSON(400, gin.H{
+				"message": "mode must be finish or interrupt",
+			})
+			return
+		}
+
+		if !s.SetPaused(true) {
+			c.JSON(409, gin.H{
+				"message": "already paused",
+			})
+			return
+		}
+
+		s.Events.Publish(notifier.Event{
+			Type: notifier.EventStreamPaused,
+		})
+		if mode == "interrupt" {
+			s.Streamer.Skip()
+		}
+
+		c.JSON(200, gin.H{
+			"message": "ok",
+		})
+	})
+	control.POST("/resume", func(c *gin.Context) {
+		if !s.SetPaused(false) {
+			c.JSON(409, gin.H{
+				"message": "not paused",
+			})
+			return
+		}
+
+		s.Events.Publish(notifier.Event{
+			Type: notifier.EventStreamResumed,
+		})
+		if s.Streamer.InStandby() {
+			s.Streamer.Skip()
+		}
+
+		c.JSON(200, gin.H{
+			"message": "ok",
+		})
+	})
+	control.POST("/skip", func(c *gin.Context) {
+		if !s.Streamer.Skip() {
+			c.JSON(409, gin.H{
+				"message": "nothing is playing",
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "ok",
+		})
+	})
+	control.POST("/enumerate", func(c *gin.Context) {
 		s.Storage.ForceEnumerate()
 		c.JSON(200, gin.H{
 			"message":     "ok",
@@ -72,20 +279,128 @@ func (s *Server) StartServer() {
 		})
 	})
 
-	err := r.Run()
-	if err != nil {
+	control.POST("/notifications/replay", func(c *gin.Context) {
+		if s.DeadLetters == nil {
+			c.JSON(404, gin.H{
+				"message": "dead letter log not configured",
+			})
+			return
+		}
+
+		replayed, err := s.DeadLetters.Replay()
+		if err != nil {
+			log.WithError(err).Warn("could not replay dead letters")
+			c.JSON(500, gin.H{
+				"message": "could not replay dead letters",
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"message":  "ok",
+			"replayed": replayed,
+		})
+	})
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	s.Lock()
+	s.httpServer = &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+	httpServer := s.httpServer
+	s.Unlock()
+
+	log.WithField("port", port).Info("web server listening")
+	err := httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.WithError(err).Error("web server failed")
 	}
 }
 
+// Shutdown stops the web server, waiting for in flight requests to finish until the context is done. Long lived
+// requests like the event stream are cut off when the event bus closes.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	httpServer := s.httpServer
+	s.Unlock()
+
+	if httpServer == nil {
+		return nil
+	}
+
+	log.Info("shutting down web server")
+	return httpServer.Shutdown(ctx)
+}
+
+// publishQueueChanged tells everyone about the new queue, and what will play next now that it has changed
+func (s *Server) publishQueueChanged() {
+	event := notifier.Event{
+		Type:         notifier.EventQueueChanged,
+		Queue:        s.Queue.List(),
+		NextVideoKey: s.comingUp(),
+	}
+	if event.NextVideoKey != "" {
+		event.NextTitle = videostorage.Title(event.NextVideoKey)
+	}
+	s.Events.Publish(event)
+}
+
+// comingUp returns what will play after the current video: the head of the queue, or failing that the video already
+// lined up
+func (s *Server) comingUp() string {
+	if key, ok := s.Queue.Peek(); ok {
+		return key
+	}
+	return s.UpNext()
+}
+
 func (s *Server) ShouldContinue() bool {
 	s.Lock()
 	defer s.Unlock()
-	return s.shouldContinue
+	return !s.stopRequested
 }
 
 func (s *Server) SetContinue(cont bool) {
 	s.Lock()
 	defer s.Unlock()
-	s.shouldContinue = cont
+	s.stopRequested = !cont
+}
+
+// IsPaused reports whether the stream should be showing the standby slate instead of videos
+func (s *Server) IsPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.paused
+}
+
+// SetPaused changes the pause state, returning false if it was already in that state
+func (s *Server) SetPaused(paused bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.paused == paused {
+		return false
+	}
+	s.paused = paused
+	return true
+}
+
+// UpNext returns the video picked to play after the current one when nothing is queued, if one has been picked.
+// Anything queued comes before it.
+func (s *Server) UpNext() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.upNext
+}
+
+// SetUpNext records the video lined up to play after the current one
+func (s *Server) SetUpNext(key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.upNext = key
 }
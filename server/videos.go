@@ -0,0 +1,94 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+const (
+	defaultVideoPageSize = 50
+	maxVideoPageSize     = 500
+)
+
+// listVideos pages through the library. Supports `prefix`, `q`, `fuzzy`, `offset` and `limit` query parameters.
+func (s *Server) listVideos(c *gin.Context) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{
+			"message": "offset must be a non-negative number",
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultVideoPageSize)))
+	if err != nil || limit < 1 || limit > maxVideoPageSize {
+		c.JSON(400, gin.H{
+			"message": "limit must be between 1 and " + strconv.Itoa(maxVideoPageSize),
+		})
+		return
+	}
+
+	fuzzy, _ := strconv.ParseBool(c.DefaultQuery("fuzzy", "false"))
+
+	videos, total := videostorage.Search(s.Storage.ListVideos(), videostorage.SearchOptions{
+		Prefix: c.Query("prefix"),
+		Query:  c.Query("q"),
+		Fuzzy:  fuzzy,
+		Offset: offset,
+		Limit:  limit,
+	})
+
+	c.JSON(200, gin.H{
+		"videos": videos,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+func (s *Server) videoDetails(c *gin.Context) {
+	video, ok := s.Storage.GetVideoInfo(c.Query("key"))
+	if !ok {
+		c.JSON(404, gin.H{
+			"message": "unknown video",
+		})
+		return
+	}
+
+	c.JSON(200, video)
+}
+
+// listFolders lists the folders directly beneath `prefix` so a client can browse the library like a file tree
+func (s *Server) listFolders(c *gin.Context) {
+	counts := videostorage.Folders(s.Storage.ListVideos(), c.Query("prefix"))
+
+	type folder struct {
+		Prefix     string `json:"prefix"`
+		VideoCount int    `json:"video_count"`
+	}
+
+	folders := make([]folder, 0, len(counts))
+	for prefix, count := range counts {
+		folders = append(folders, folder{prefix, count})
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Prefix < folders[j].Prefix
+	})
+
+	c.JSON(200, gin.H{
+		"folders": folders,
+	})
+}
+
+// listInvalid returns the videos that failed validation, and why
+func (s *Server) listInvalid(c *gin.Context) {
+	invalid := s.Storage.InvalidVideos()
+	c.JSON(200, gin.H{
+		"total":  len(invalid),
+		"videos": invalid,
+	})
+}
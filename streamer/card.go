@@ -0,0 +1,81 @@
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cardName is how cards show up in the logs and in GetInterstitial
+const cardName = "up next card"
+
+// Card is a short segment generated by ffmpeg to play between videos, with text over a plain background
+type Card struct {
+	// Text is centred on the card, and may run over several lines
+	Text string
+	// Branding is optional smaller text along the bottom of the card
+	Branding string
+	Duration time.Duration
+	// Background is any colour ffmpeg understands, like `black` or `#1e1e2e`
+	Background string
+	FontFile   string
+}
+
+func (s *Streamer) cardArgs(card Card, textFile string, brandingFile string) []string {
+	seconds := strconv.FormatFloat(card.Duration.Seconds(), 'f', 3, 64)
+
+	filter := drawtextFilter(textFile, card.FontFile, 56, "(h-text_h)/2")
+	if brandingFile != "" {
+		filter += "," + drawtextFilter(brandingFile, card.FontFile, 32, "h-text_h-60")
+	}
+
+	args := []string{
+		"-loglevel", "warning",
+		"-hide_banner",
+		"-re",
+		"-f", "lavfi", "-i", fmt.Sprintf("color=c=%s:size=1280x720:rate=%d", card.Background, generatedFrameRate),
+		"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100",
+		"-t", seconds,
+		"-vf", filter,
+	}
+	return append(args, s.encodeArgs(generatedFrameRate)...)
+}
+
+// StartCard generates a card and streams it, returning once it has played for its duration. Like interstitials, cards
+// don't count as plays, aren't recorded in the history and don't publish progress events. Skip and Stop end the card
+// early with ErrSkipped or ErrStopped.
+func (s *Streamer) StartCard(card Card) error {
+	s.Lock()
+	s.video = ""
+	s.interstitial = cardName
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.interstitial = ""
+		s.Unlock()
+	}()
+
+	textFile, err := writeTextFile(card.Text)
+	if err != nil {
+		log.WithError(err).Error("could not write card text")
+		return err
+	}
+	defer os.Remove(textFile)
+
+	brandingFile := ""
+	if card.Branding != "" {
+		brandingFile, err = writeTextFile(card.Branding)
+		if err != nil {
+			log.WithError(err).Error("could not write card branding")
+			return err
+		}
+		defer os.Remove(brandingFile)
+	}
+
+	log.WithField("duration", card.Duration.String()).Info("starting up next card")
+	return s.runFfmpeg(cardName, s.cardArgs(card, textFile, brandingFile), nil)
+}
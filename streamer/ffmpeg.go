@@ -2,25 +2,67 @@ package streamer
 
 import (
 	"bufio"
+	"errors"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/lthummus/bucket-stream/notifier"
+	"github.com/lthummus/bucket-stream/videostorage"
+)
+
+// ErrSkipped is returned by StartFfmpegStream when the video was cut short by a call to Skip
+var ErrSkipped = errors.New("video skipped")
+
+// ErrStopped is returned by StartFfmpegStream when the video was cut short by a call to Stop
+var ErrStopped = errors.New("video stopped")
+
+// stopGracePeriod is how long ffmpeg gets to exit on its own after Stop before it is killed
+const stopGracePeriod = 5 * time.Second
+
+const maxHistory = 50
+
+const (
+	ResultFinished = "finished"
+	ResultSkipped  = "skipped"
+	ResultErrored  = "errored"
+	ResultStopped  = "stopped"
 )
 
+// HistoryEntry records a video that has finished playing, one way or another
+type HistoryEntry struct {
+	Video  string    `json:"video"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Result string    `json:"result"`
+}
+
 type Streamer struct {
 	sync.Mutex
 
 	FfmpegPath     string
 	TwitchEndpoint string
 
+	// Events, if set, receives a progress event about once a second while a video is playing
+	Events notifier.Notifier
+
 	VideoStart time.Time
 	PlayCount  int
 
-	video string
+	video   string
+	cmd     *exec.Cmd
+	input   io.ReadCloser
+	skipped bool
+	stopped bool
+	standby bool
+	history []HistoryEntry
+
+	interstitial string
 }
 
 func (s *Streamer) SetVideo(video string) {
@@ -37,7 +79,150 @@ func (s *Streamer) GetVideo() string {
 	return s.video
 }
 
-func captureOutput(r io.Reader) {
+// GetHistory returns the most recently played videos, newest first
+func (s *Streamer) GetHistory() []HistoryEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	res := make([]HistoryEntry, len(s.history))
+	for i, curr := range s.history {
+		res[len(s.history)-1-i] = curr
+	}
+	return res
+}
+
+func (s *Streamer) recordHistory(video string, start time.Time, result string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.history = append(s.history, HistoryEntry{
+		Video:  video,
+		Start:  start,
+		End:    time.Now(),
+		Result: result,
+	})
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+}
+
+// publishProgress sends a progress event every second until `stop` is closed
+func (s *Streamer) publishProgress(name string, playIndex int, start time.Time, stop <-chan struct{}) {
+	if s.Events == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	title := videostorage.Title(name)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Events.Notify(notifier.Event{
+				Type:            notifier.EventProgress,
+				VideoKey:        name,
+				Title:           title,
+				PlayIndex:       playIndex,
+				VideoStartedAt:  &start,
+				DurationSeconds: time.Since(start).Seconds(),
+			})
+		}
+	}
+}
+
+// Skip kills the ffmpeg process for the video that is currently playing, which causes StartFfmpegStream to return
+// ErrSkipped. Returns false if nothing is playing.
+func (s *Streamer) Skip() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cmd == nil || s.cmd.Process == nil {
+		return false
+	}
+
+	s.skipped = true
+	if err := s.cmd.Process.Kill(); err != nil {
+		log.WithField("video", s.video).WithError(err).Warn("could not kill ffmpeg")
+		return false
+	}
+	s.closeInput()
+
+	log.WithField("video", s.video).Info("skipping video")
+	return true
+}
+
+// Stop ends the current video cleanly. ffmpeg is interrupted so it can close the RTMP session properly, and the video
+// input is closed so nothing is left waiting on S3. If ffmpeg hasn't exited after a few seconds it is killed.
+// StartFfmpegStream then returns ErrStopped. Returns false if nothing is playing.
+func (s *Streamer) Stop() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cmd == nil || s.cmd.Process == nil {
+		return false
+	}
+
+	cmd := s.cmd
+	s.stopped = true
+	log.WithField("video", s.video).Info("stopping ffmpeg")
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		log.WithField("video", s.video).WithError(err).Warn("could not interrupt ffmpeg")
+	}
+	s.closeInput()
+
+	time.AfterFunc(stopGracePeriod, func() {
+		s.Lock()
+		defer s.Unlock()
+
+		if s.cmd == cmd {
+			log.WithField("video", s.video).Warn("ffmpeg did not exit in time, killing it")
+			_ = cmd.Process.Kill()
+		}
+	})
+
+	return true
+}
+
+// closeInput closes the input of the running ffmpeg process, if it has one, so the goroutine copying it to ffmpeg isn't
+// left blocked on a read. Must be called with the lock held.
+func (s *Streamer) closeInput() {
+	if s.input == nil {
+		return
+	}
+
+	if err := s.input.Close(); err != nil {
+		log.WithField("video", s.video).WithError(err).Warn("could not close video input")
+	}
+}
+
+// StreamKey returns the stream key part of an RTMP endpoint, which is its last path segment
+func StreamKey(endpoint string) string {
+	key := endpoint[strings.LastIndex(endpoint, "/")+1:]
+	if idx := strings.Index(key, "?"); idx >= 0 {
+		key = key[:idx]
+	}
+	return key
+}
+
+// redactEndpoint hides the stream key in anything ffmpeg prints, since its RTMP errors include the output URL and the
+// log ends up in the dashboard
+func redactEndpoint(line string, endpoint string) string {
+	if endpoint == "" {
+		return line
+	}
+	line = strings.ReplaceAll(line, endpoint, "<twitch endpoint>")
+	if key := StreamKey(endpoint); key != "" {
+		line = strings.ReplaceAll(line, key, "<stream key>")
+	}
+	return line
+}
+
+// captureOutput logs everything ffmpeg prints, with the stream key in `endpoint` redacted
+func captureOutput(r io.Reader, endpoint string) {
 	reader := bufio.NewReader(r)
 	var line string
 	var err error
@@ -49,7 +234,7 @@ func captureOutput(r io.Reader) {
 		}
 		line = strings.TrimSpace(line)
 		if line != "" {
-			log.Warn(line)
+			log.Warn(redactEndpoint(line, endpoint))
 		}
 		if err != nil {
 			break
@@ -59,15 +244,81 @@ func captureOutput(r io.Reader) {
 
 // StartFfmpegStream starts streaming to twitch. This requires a path to the ffmpeg executable, the twitch endpoint,
 // the video's name (for logging) and an `io.ReadCloser` to read video data from. The video is assumed to be in an
-// FLV container with codecs that Twitch is happy with (see README for more details).
-func (s *Streamer) StartFfmpegStream(name string, videoInput io.ReadCloser) {
+// FLV container with codecs that Twitch is happy with (see README for more details). The video input is always closed
+// before returning. If the video was skipped, ErrSkipped is returned, and if it was stopped, ErrStopped is returned.
+func (s *Streamer) StartFfmpegStream(name string, videoInput io.ReadCloser) error {
+	defer func() {
+		if err := videoInput.Close(); err != nil {
+			log.WithField("video", name).WithError(err).Warn("error closing video input")
+		}
+		log.WithField("video", name).Info("closed video input stream")
+	}()
+
+	start := time.Now()
 	s.Lock()
 	s.video = name
-	s.VideoStart = time.Now()
+	s.VideoStart = start
 	s.PlayCount += 1
+	playIndex := s.PlayCount
+	s.Unlock()
+
+	log.WithField("video", name).Info("beginning stream")
+
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go s.publishProgress(name, playIndex, start, stopProgress)
+
+	err := s.runFfmpeg(name, s.copyArgs(), videoInput)
+	switch {
+	case err == ErrStopped:
+		s.recordHistory(name, start, ResultStopped)
+	case err == ErrSkipped:
+		s.recordHistory(name, start, ResultSkipped)
+	case err != nil:
+		s.recordHistory(name, start, ResultErrored)
+	default:
+		s.recordHistory(name, start, ResultFinished)
+	}
+
+	return err
+}
+
+// StartInterstitial streams a clip from the interstitial pool, which must be encoded for Twitch like any other video.
+// Interstitials don't count as plays, aren't recorded in the history and don't publish progress events. The input is
+// always closed before returning, and ErrSkipped or ErrStopped are returned as for StartFfmpegStream.
+func (s *Streamer) StartInterstitial(name string, input io.ReadCloser) error {
+	defer func() {
+		if err := input.Close(); err != nil {
+			log.WithField("interstitial", name).WithError(err).Warn("error closing interstitial input")
+		}
+	}()
+
+	s.Lock()
+	s.video = ""
+	s.interstitial = name
 	s.Unlock()
 
-	var command = []string{
+	defer func() {
+		s.Lock()
+		s.interstitial = ""
+		s.Unlock()
+	}()
+
+	log.WithField("interstitial", name).Info("starting interstitial")
+	return s.runFfmpeg(name, s.copyArgs(), input)
+}
+
+// GetInterstitial returns the interstitial that is currently streaming, if there is one
+func (s *Streamer) GetInterstitial() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.interstitial
+}
+
+// copyArgs are the arguments for streaming something that is already encoded for Twitch from stdin
+func (s *Streamer) copyArgs() []string {
+	return []string{
 		"-loglevel", // only log warnings
 		"warning",
 		"-hide_banner", // don't bother echoing out the codecs and build information
@@ -82,36 +333,66 @@ func (s *Streamer) StartFfmpegStream(name string, videoInput io.ReadCloser) {
 		"no_duration_filesize",
 		s.TwitchEndpoint,
 	}
-	log.WithField("video", name).Info("beginning stream")
+}
 
+// runFfmpeg runs ffmpeg with the given arguments, feeding it `input` (which may be nil) on stdin and logging anything
+// it prints. It blocks until ffmpeg exits, returning ErrSkipped or ErrStopped if Skip or Stop ended it early.
+func (s *Streamer) runFfmpeg(name string, command []string, input io.ReadCloser) error {
 	// build the process
 	r := exec.Command(s.FfmpegPath, command...)
-	r.Stdin = videoInput          // hook the video byte stream to the stdin of ffmpeg
+	if input != nil {
+		r.Stdin = input // hook the video byte stream to the stdin of ffmpeg
+	}
 	stderr, err := r.StderrPipe() // set up reading from ffmpeg's output
 	if err != nil {
-		log.WithField("video", name).WithError(err).Fatal("error opening stderr")
+		log.WithField("video", name).WithError(err).Error("error opening stderr")
+		return err
 	}
 	if err = r.Start(); err != nil {
-		log.WithField("video", name).WithError(err).Fatal("error starting ffmpeg")
+		log.WithField("video", name).WithError(err).Error("error starting ffmpeg")
+		return err
 	}
+
+	s.Lock()
+	s.cmd = r
+	s.input = input
+	s.skipped = false
+	s.stopped = false
+	s.Unlock()
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		captureOutput(stderr)
+		captureOutput(stderr, s.TwitchEndpoint)
 		wg.Done()
 	}()
 
 	wg.Wait() // wait until stream is done
 	log.WithField("video", name).Info("Waiting for process to exit")
 	err = r.Wait()
-	if err != nil {
-		log.WithField("video", name).WithError(err).Fatal("error on wait")
+
+	s.Lock()
+	skipped := s.skipped
+	stopped := s.stopped
+	s.cmd = nil
+	s.input = nil
+	s.skipped = false
+	s.stopped = false
+	s.Unlock()
+
+	if stopped {
+		log.WithField("video", name).Info("stream stopped")
+		return ErrStopped
+	}
+	if skipped {
+		log.WithField("video", name).Info("stream skipped")
+		return ErrSkipped
 	}
-	// close everything
-	err = videoInput.Close()
 	if err != nil {
-		log.WithField("video", name).WithError(err).Fatal("error closing video input")
+		log.WithField("video", name).WithError(err).Error("error on wait")
+		return err
 	}
-	log.WithField("video", name).Info("closed video input stream")
+
 	log.WithField("video", name).Info("stream finished")
+	return nil
 }
@@ -0,0 +1,31 @@
+package streamer
+
+import "testing"
+
+func TestRedactEndpoint(t *testing.T) {
+	endpoint := "rtmp://live.twitch.tv/app/live_123456_secret?bandwidthtest=true"
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"whole endpoint", "Error opening output " + endpoint + ": I/O error", "Error opening output <twitch endpoint>: I/O error"},
+		{"url without the query", "rtmp://live.twitch.tv/app/live_123456_secret: Broken pipe", "rtmp://live.twitch.tv/app/<stream key>: Broken pipe"},
+		{"nothing secret", "frame=  100 fps= 30", "frame=  100 fps= 30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactEndpoint(tt.line, endpoint); got != tt.want {
+				t.Errorf("redactEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamKey(t *testing.T) {
+	if got := StreamKey("rtmp://live.twitch.tv/app/live_1_abc?bandwidthtest=true"); got != "live_1_abc" {
+		t.Errorf("StreamKey() = %q, want live_1_abc", got)
+	}
+}
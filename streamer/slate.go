@@ -0,0 +1,183 @@
+package streamer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// SlateSourceBars generates colour bars with a text overlay
+	SlateSourceBars = "bars"
+	// SlateSourceImage loops a still image
+	SlateSourceImage = "image"
+	// SlateSourceVideo loops a video file, which must already be encoded for Twitch like everything else
+	SlateSourceVideo = "video"
+
+	defaultSlateText = "We'll be right back"
+
+	// generatedFrameRate is the frame rate of everything we generate ourselves, like slates and cards
+	generatedFrameRate = 30
+	// keyframeIntervalSeconds is how often generated video has a keyframe. Twitch asks for one every 2 seconds.
+	keyframeIntervalSeconds = 2
+)
+
+// Slate describes what to stream while on standby
+type Slate struct {
+	Source   string
+	File     string
+	Text     string
+	FontFile string
+}
+
+// SlateFromConfig reads the `standby` section of the config. Without any config, the slate is colour bars with a
+// "be right back" message.
+func SlateFromConfig() Slate {
+	slate := Slate{
+		Source:   viper.GetString("standby.source"),
+		File:     viper.GetString("standby.file"),
+		Text:     viper.GetString("standby.text"),
+		FontFile: viper.GetString("standby.font_file"),
+	}
+
+	if slate.Source == "" {
+		slate.Source = SlateSourceBars
+	}
+	if slate.Text == "" {
+		slate.Text = defaultSlateText
+	}
+
+	switch slate.Source {
+	case SlateSourceBars:
+	case SlateSourceImage, SlateSourceVideo:
+		if slate.File == "" {
+			log.WithField("source", slate.Source).Fatal("standby.file is required for this standby source")
+		}
+	default:
+		log.WithField("source", slate.Source).Fatal("standby.source must be bars, image or video")
+	}
+
+	return slate
+}
+
+// drawtextFilter builds a drawtext filter that centres the contents of `textFile` on a translucent box. Reading the
+// text from a file sidesteps ffmpeg's several layers of filter graph escaping. `textFile` must be a path we created,
+// since it is only lightly escaped.
+func drawtextFilter(textFile string, fontFile string, fontSize int, y string) string {
+	filter := fmt.Sprintf("drawtext=textfile='%s':expansion=none:fontcolor=white:fontsize=%d:x=(w-text_w)/2:y=%s:box=1:boxcolor=black@0.6:boxborderw=20",
+		textFile, fontSize, y)
+	if fontFile != "" {
+		filter += fmt.Sprintf(":fontfile='%s'", fontFile)
+	}
+	return filter
+}
+
+// writeTextFile writes `text` to a temporary file for drawtext to read. The caller should remove it when ffmpeg exits.
+func writeTextFile(text string) (string, error) {
+	f, err := ioutil.TempFile("", "bucket-stream-text-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(text); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// encodeArgs are the output arguments for anything we generate ourselves rather than copying from storage, at
+// `frameRate` frames per second. They match the encoding recommended in the README for pre-encoded videos, with a
+// keyframe every keyframeIntervalSeconds whatever the frame rate.
+func (s *Streamer) encodeArgs(frameRate int) []string {
+	gop := strconv.Itoa(frameRate * keyframeIntervalSeconds)
+	return []string{
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-b:v", "3000k",
+		"-maxrate", "3000k",
+		"-bufsize", "6000k",
+		"-pix_fmt", "yuv420p",
+		"-g", gop,
+		"-keyint_min", gop,
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-ac", "2",
+		"-ar", "44100",
+		"-f", "flv",
+		"-flvflags", "no_duration_filesize",
+		s.TwitchEndpoint,
+	}
+}
+
+func (s *Streamer) slateArgs(slate Slate, textFile string) []string {
+	args := []string{
+		"-loglevel", "warning",
+		"-hide_banner",
+	}
+
+	silence := []string{"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100"}
+
+	switch slate.Source {
+	case SlateSourceVideo:
+		args = append(args,
+			"-re",
+			"-stream_loop", "-1",
+			"-i", slate.File,
+			"-c", "copy",
+			"-f", "flv",
+			"-flvflags", "no_duration_filesize",
+			s.TwitchEndpoint,
+		)
+		return args
+	case SlateSourceImage:
+		args = append(args, "-re", "-loop", "1", "-framerate", strconv.Itoa(generatedFrameRate), "-i", slate.File)
+		args = append(args, silence...)
+		args = append(args, "-vf", "scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2")
+	default:
+		args = append(args, "-re", "-f", "lavfi", "-i", fmt.Sprintf("smptehdbars=size=1280x720:rate=%d", generatedFrameRate))
+		args = append(args, silence...)
+		args = append(args, "-vf", drawtextFilter(textFile, slate.FontFile, 64, "(h-text_h)/2"))
+	}
+
+	return append(args, s.encodeArgs(generatedFrameRate)...)
+}
+
+// StartSlate streams the standby slate until Skip or Stop is called, which end it with ErrSkipped or ErrStopped
+// respectively. Slates don't count as plays and aren't recorded in the history.
+func (s *Streamer) StartSlate(slate Slate) error {
+	s.Lock()
+	s.video = ""
+	s.standby = true
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.standby = false
+		s.Unlock()
+	}()
+
+	textFile, err := writeTextFile(slate.Text)
+	if err != nil {
+		log.WithError(err).Error("could not write standby slate text")
+		return err
+	}
+	defer os.Remove(textFile)
+
+	log.WithField("source", slate.Source).Info("starting standby slate")
+	return s.runFfmpeg("standby slate", s.slateArgs(slate, textFile), nil)
+}
+
+// InStandby reports whether the standby slate is currently streaming
+func (s *Streamer) InStandby() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.standby
+}
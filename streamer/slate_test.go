@@ -0,0 +1,53 @@
+package streamer
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// argValue returns the value following `flag` in ffmpeg arguments
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestKeyframeIntervalFollowsFrameRate(t *testing.T) {
+	s := &Streamer{TwitchEndpoint: "rtmp://live.twitch.tv/app/key"}
+
+	for _, fps := range []int{25, 30, 60} {
+		args := s.encodeArgs(fps)
+		want := strconv.Itoa(fps * keyframeIntervalSeconds)
+		if got := argValue(args, "-g"); got != want {
+			t.Errorf("at %d fps, -g is %s, want %s", fps, got, want)
+		}
+		if got := argValue(args, "-keyint_min"); got != want {
+			t.Errorf("at %d fps, -keyint_min is %s, want %s", fps, got, want)
+		}
+	}
+}
+
+func TestGeneratedVideoHasTwoSecondKeyframes(t *testing.T) {
+	s := &Streamer{TwitchEndpoint: "rtmp://live.twitch.tv/app/key"}
+	rate := strconv.Itoa(generatedFrameRate)
+
+	generated := map[string][]string{
+		"bars":  s.slateArgs(Slate{Source: SlateSourceBars}, "text.txt"),
+		"image": s.slateArgs(Slate{Source: SlateSourceImage, File: "slate.png"}, "text.txt"),
+		"card":  s.cardArgs(Card{Duration: 5 * time.Second, Background: "black"}, "text.txt", ""),
+	}
+	for name, args := range generated {
+		joined := strings.Join(args, " ")
+		if !strings.Contains(joined, "rate="+rate) && argValue(args, "-framerate") != rate {
+			t.Errorf("%s isn't generated at %s fps: %s", name, rate, joined)
+		}
+		if got := argValue(args, "-g"); got != strconv.Itoa(2*generatedFrameRate) {
+			t.Errorf("%s has -g %s, want a keyframe every 2 seconds at %s fps", name, got, rate)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package videostorage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/atomicfile"
+)
+
+const (
+	// EvictLeastRecentlyUsed removes whatever was played longest ago first
+	EvictLeastRecentlyUsed = "lru"
+	// EvictLeastFrequentlyUsed removes whatever has been played from the cache the fewest times first
+	EvictLeastFrequentlyUsed = "lfu"
+
+	cacheIndexFile     = "index.json"
+	partialFileSuffix  = ".partial"
+	defaultCacheSizeMb = 10 * 1024
+)
+
+// CacheStats describes how well the disk cache is doing
+type CacheStats struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Entries      int   `json:"entries"`
+	SizeBytes    int64 `json:"size_bytes"`
+	MaxSizeBytes int64 `json:"max_size_bytes"`
+}
+
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	ETag     string    `json:"etag"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	Uses     int       `json:"uses"`
+}
+
+// diskCache wraps another storage, keeping copies of videos on local disk so videos that come around again don't have
+// to be downloaded again. Videos are copied to disk as they stream, so a miss costs nothing extra. A cached copy is
+// only used while its ETag matches the video in storage.
+type diskCache struct {
+	Storage
+
+	dir      string
+	maxBytes int64
+	policy   string
+
+	lock        sync.Mutex
+	entries     map[string]*cacheEntry
+	size        int64
+	downloading map[string]bool
+	hits        int64
+	misses      int64
+}
+
+var _ Storage = &diskCache{}
+
+// DiskCacheFromConfig reads the `cache` section of the config and wraps `inner` in a disk cache. Returns nil if no
+// cache directory is configured.
+func DiskCacheFromConfig(inner Storage) *diskCache {
+	dir := viper.GetString("cache.dir")
+	if dir == "" {
+		return nil
+	}
+
+	maxSizeMb := viper.GetInt64("cache.max_size_mb")
+	if maxSizeMb == 0 {
+		maxSizeMb = defaultCacheSizeMb
+	}
+
+	policy := viper.GetString("cache.eviction")
+	switch policy {
+	case "":
+		policy = EvictLeastRecentlyUsed
+	case EvictLeastRecentlyUsed, EvictLeastFrequentlyUsed:
+	default:
+		log.WithField("eviction", policy).Fatal("cache.eviction must be lru or lfu")
+	}
+
+	return NewDiskCache(inner, dir, maxSizeMb*1024*1024, policy)
+}
+
+// NewDiskCache wraps `inner` in a cache kept in `dir`, holding at most `maxBytes` of video. Anything left half
+// downloaded by a crash is cleaned up, as is anything in the directory that the index doesn't know about.
+func NewDiskCache(inner Storage, dir string, maxBytes int64, policy string) *diskCache {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.WithError(err).WithField("dir", dir).Fatal("could not create cache directory")
+	}
+
+	c := &diskCache{
+		Storage:     inner,
+		dir:         dir,
+		maxBytes:    maxBytes,
+		policy:      policy,
+		entries:     make(map[string]*cacheEntry),
+		downloading: make(map[string]bool),
+	}
+	c.load()
+
+	log.WithFields(log.Fields{
+		"dir":        dir,
+		"entries":    len(c.entries),
+		"size_bytes": c.size,
+		"max_bytes":  maxBytes,
+		"eviction":   policy,
+	}).Info("disk cache initialized")
+
+	return c
+}
+
+// load reads the index, dropping entries whose file has gone missing and deleting files the index doesn't mention
+func (c *diskCache) load() {
+	var entries []*cacheEntry
+	contents, err := ioutil.ReadFile(filepath.Join(c.dir, cacheIndexFile))
+	if err == nil {
+		if err := json.Unmarshal(contents, &entries); err != nil {
+			log.WithError(err).Warn("cache index is corrupt, starting over")
+			entries = nil
+		}
+	} else if !os.IsNotExist(err) {
+		log.WithError(err).Warn("could not read cache index")
+	}
+
+	known := make(map[string]bool)
+	for _, curr := range entries {
+		info, err := os.Stat(c.path(curr.Key))
+		if err != nil || info.Size() != curr.Size {
+			continue
+		}
+		c.entries[curr.Key] = curr
+		c.size += curr.Size
+		known[filepath.Base(c.path(curr.Key))] = true
+	}
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.WithError(err).Warn("could not list cache directory")
+		return
+	}
+	for _, curr := range files {
+		if curr.Name() == cacheIndexFile || known[curr.Name()] {
+			continue
+		}
+		if strings.HasSuffix(curr.Name(), partialFileSuffix) {
+			log.WithField("file", curr.Name()).Info("removing partial download left behind")
+		}
+		if err := os.Remove(filepath.Join(c.dir, curr.Name())); err != nil {
+			log.WithError(err).WithField("file", curr.Name()).Warn("could not remove stray cache file")
+		}
+	}
+
+	c.saveIndex()
+}
+
+// path is where the cached copy of a video lives. Keys are hashed since they can contain slashes and anything else.
+func (c *diskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+".flv")
+}
+
+// saveIndex writes the index out atomically. Must be called with the lock held.
+func (c *diskCache) saveIndex() {
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, curr := range c.entries {
+		entries = append(entries, curr)
+	}
+
+	contents, err := json.Marshal(entries)
+	if err != nil {
+		log.WithError(err).Warn("could not marshal cache index")
+		return
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(c.dir, cacheIndexFile), contents, 0644); err != nil {
+		log.WithError(err).Warn("could not write cache index")
+	}
+}
+
+// PickVideo picks at random like the wrapped storage, but opens the video through the cache
+func (c *diskCache) PickVideo() (string, io.ReadCloser, error) {
+	video, ok := c.ChooseVideo(func(Video) bool { return true })
+	if !ok {
+		return c.Storage.PickVideo()
+	}
+
+	buf, err := c.OpenVideo(video.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	return video.Key, buf, nil
+}
+
+// OpenVideo serves the video from disk if there is an up to date copy. Otherwise it is opened from the wrapped
+// storage and copied to disk as it is read.
+func (c *diskCache) OpenVideo(key string) (io.ReadCloser, error) {
+	video, ok := c.GetVideoInfo(key)
+	if !ok {
+		return c.Storage.OpenVideo(key)
+	}
+	logger := log.WithField("video", key)
+
+	c.lock.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if entry.ETag == video.ETag {
+			f, err := os.Open(c.path(key))
+			if err == nil {
+				entry.LastUsed = time.Now()
+				entry.Uses++
+				c.hits++
+				c.saveIndex()
+				c.lock.Unlock()
+
+				logger.Info("playing video from disk cache")
+				return &cachedFile{File: f}, nil
+			}
+			logger.WithError(err).Warn("could not open cached video")
+		} else {
+			logger.Info("cached video is out of date")
+		}
+		c.remove(key)
+	}
+	c.misses++
+
+	// only one copy of a video is written at a time, and anything that could never fit isn't worth writing
+	cacheIt := !c.downloading[key] && video.Size <= c.maxBytes
+	if cacheIt {
+		c.downloading[key] = true
+	}
+	c.lock.Unlock()
+
+	buf, err := c.Storage.OpenVideo(key)
+	if err != nil || !cacheIt {
+		if cacheIt {
+			c.lock.Lock()
+			delete(c.downloading, key)
+			c.lock.Unlock()
+		}
+		return buf, err
+	}
+
+	partial, err := os.Create(c.path(key) + partialFileSuffix)
+	if err != nil {
+		logger.WithError(err).Warn("could not create cache file")
+		c.lock.Lock()
+		delete(c.downloading, key)
+		c.lock.Unlock()
+		return buf, nil
+	}
+
+	return &cachingReader{
+		cache:   c,
+		video:   video,
+		source:  buf,
+		partial: partial,
+	}, nil
+}
+
+// remove deletes a video from the cache. Must be called with the lock held.
+func (c *diskCache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("video", key).Warn("could not remove cached video")
+	}
+	c.size -= entry.Size
+	delete(c.entries, key)
+	c.saveIndex()
+}
+
+// add records a freshly downloaded video, evicting others to make room for it
+func (c *diskCache) add(video Video, partialPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.downloading, video.Key)
+	c.remove(video.Key)
+
+	if err := os.Rename(partialPath, c.path(video.Key)); err != nil {
+		log.WithError(err).WithField("video", video.Key).Warn("could not move cached video in to place")
+		_ = os.Remove(partialPath)
+		return
+	}
+
+	c.entries[video.Key] = &cacheEntry{
+		Key:      video.Key,
+		ETag:     video.ETag,
+		Size:     video.Size,
+		LastUsed: time.Now(),
+		Uses:     1,
+	}
+	c.size += video.Size
+	c.evict(video.Key)
+	c.saveIndex()
+
+	log.WithFields(log.Fields{
+		"video":      video.Key,
+		"size_bytes": c.size,
+	}).Info("added video to disk cache")
+}
+
+// evict removes videos according to the eviction policy until the cache fits, never removing `keep`. Must be called
+// with the lock held.
+func (c *diskCache) evict(keep string) {
+	if c.size <= c.maxBytes {
+		return
+	}
+
+	candidates := make([]*cacheEntry, 0, len(c.entries))
+	for _, curr := range c.entries {
+		if curr.Key != keep {
+			candidates = append(candidates, curr)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if c.policy == EvictLeastFrequentlyUsed && candidates[i].Uses != candidates[j].Uses {
+			return candidates[i].Uses < candidates[j].Uses
+		}
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+
+	for _, curr := range candidates {
+		if c.size <= c.maxBytes {
+			break
+		}
+		log.WithField("video", curr.Key).Info("evicting video from disk cache")
+		c.remove(curr.Key)
+	}
+}
+
+// abandon throws away a download that didn't complete
+func (c *diskCache) abandon(key string, partialPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.downloading, key)
+	if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("video", key).Warn("could not remove partial cache file")
+	}
+}
+
+// CacheStats reports hits, misses and how full the cache is
+func (c *diskCache) CacheStats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Hits:         c.hits,
+		Misses:       c.misses,
+		Entries:      len(c.entries),
+		SizeBytes:    c.size,
+		MaxSizeBytes: c.maxBytes,
+	}
+}
+
+// cachedFile is a video being played from the disk cache. The streamer closes its input both when a video is skipped
+// and when it is done with it, so closing more than once is fine.
+type cachedFile struct {
+	*os.File
+	once sync.Once
+	err  error
+}
+
+func (f *cachedFile) Close() error {
+	f.once.Do(func() {
+		f.err = f.File.Close()
+	})
+	return f.err
+}
+
+// cachingReader passes a video through from storage while writing a copy to disk. The copy is only kept if the whole
+// video was read; a video that is skipped or fails part way is thrown away. Problems writing the copy never affect
+// the stream. Close may be called while a Read is blocked, which is how the streamer skips videos.
+type cachingReader struct {
+	sync.Mutex
+
+	cache   *diskCache
+	video   Video
+	source  io.ReadCloser
+	partial *os.File
+
+	written  int64
+	complete bool
+	failed   bool
+	closed   bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return n, err
+	}
+	if n > 0 && !r.failed {
+		if _, writeErr := r.partial.Write(p[:n]); writeErr != nil {
+			log.WithError(writeErr).WithField("video", r.video.Key).Warn("could not write to cache, not caching this video")
+			r.failed = true
+		}
+		r.written += int64(n)
+	}
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	// close the source first so a blocked Read returns
+	err := r.source.Close()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return err
+	}
+	r.closed = true
+
+	path := r.partial.Name()
+	closeErr := r.partial.Close()
+	if r.complete && !r.failed && closeErr == nil && r.written == r.video.Size {
+		r.cache.add(r.video, path)
+	} else {
+		r.cache.abandon(r.video.Key, path)
+	}
+
+	return err
+}
@@ -0,0 +1,314 @@
+package videostorage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeLibrary is storage holding videos in memory. Videos are opened through `open` if it is set, and every open is
+// counted.
+type fakeLibrary struct {
+	Storage
+	sync.Mutex
+
+	videos   map[string]Video
+	contents map[string][]byte
+	opens    map[string]int
+	open     func(key string, contents []byte) io.ReadCloser
+}
+
+func newFakeLibrary() *fakeLibrary {
+	return &fakeLibrary{
+		videos:   make(map[string]Video),
+		contents: make(map[string][]byte),
+		opens:    make(map[string]int),
+	}
+}
+
+// put adds or replaces a video made up of `size` copies of `fill`
+func (l *fakeLibrary) put(key string, etag string, fill byte, size int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.videos[key] = Video{Key: key, ETag: etag, Size: int64(size)}
+	l.contents[key] = bytes.Repeat([]byte{fill}, size)
+}
+
+func (l *fakeLibrary) GetVideoInfo(key string) (Video, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	video, ok := l.videos[key]
+	return video, ok
+}
+
+func (l *fakeLibrary) OpenVideo(key string) (io.ReadCloser, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.opens[key]++
+	if l.open != nil {
+		return l.open(key, l.contents[key]), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(l.contents[key])), nil
+}
+
+func (l *fakeLibrary) openCount(key string) int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.opens[key]
+}
+
+// play reads a video all the way through the cache, the way the streamer does
+func play(t *testing.T, c *diskCache, key string) []byte {
+	t.Helper()
+
+	buf, err := c.OpenVideo(key)
+	if err != nil {
+		t.Fatalf("OpenVideo(%s) = %v", key, err)
+	}
+	contents, err := ioutil.ReadAll(buf)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	if err := buf.Close(); err != nil {
+		t.Fatalf("closing %s: %v", key, err)
+	}
+	return contents
+}
+
+func cachedKeys(c *diskCache) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var keys []string
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cacheFiles lists what is in the cache directory besides the index
+func cacheFiles(t *testing.T, c *diskCache) []string {
+	t.Helper()
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, curr := range files {
+		if curr.Name() != cacheIndexFile {
+			names = append(names, curr.Name())
+		}
+	}
+	return names
+}
+
+func TestCacheEviction(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		// a was played most but longest ago, b was played once since
+		{EvictLeastRecentlyUsed, []string{"b", "c"}},
+		{EvictLeastFrequentlyUsed, []string{"a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			library := newFakeLibrary()
+			library.put("a", "a1", 'a', 100)
+			library.put("b", "b1", 'b', 100)
+			library.put("c", "c1", 'c', 100)
+			c := NewDiskCache(library, t.TempDir(), 250, tt.policy)
+
+			for _, key := range []string{"a", "a", "a", "b", "c"} {
+				play(t, c, key)
+			}
+
+			if got := cachedKeys(c); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("cache holds %v, want %v", got, tt.want)
+			}
+			if library.openCount("a") != 1 {
+				t.Errorf("a was downloaded %d times, want once with the rest from the cache", library.openCount("a"))
+			}
+			if stats := c.CacheStats(); stats.Hits != 2 || stats.Misses != 3 || stats.SizeBytes != 200 {
+				t.Errorf("stats = %+v, want 2 hits, 3 misses and 200 bytes", stats)
+			}
+			if files := cacheFiles(t, c); len(files) != 2 {
+				t.Errorf("cache directory holds %v, want the 2 cached videos", files)
+			}
+		})
+	}
+}
+
+func TestCacheRefetchesChangedVideo(t *testing.T) {
+	library := newFakeLibrary()
+	library.put("a", "v1", '1', 100)
+	c := NewDiskCache(library, t.TempDir(), 1000, EvictLeastRecentlyUsed)
+
+	play(t, c, "a")
+	play(t, c, "a")
+	if library.openCount("a") != 1 {
+		t.Fatalf("a was downloaded %d times before it changed, want once", library.openCount("a"))
+	}
+
+	// re-uploaded with different contents
+	library.put("a", "v2", '2', 120)
+	if got := play(t, c, "a"); !bytes.Equal(got, bytes.Repeat([]byte{'2'}, 120)) {
+		t.Fatal("played the old copy after the video changed")
+	}
+	if library.openCount("a") != 2 {
+		t.Errorf("a was downloaded %d times, want it fetched again once it changed", library.openCount("a"))
+	}
+
+	// the new copy replaces the old one and is used from then on
+	if got := play(t, c, "a"); !bytes.Equal(got, bytes.Repeat([]byte{'2'}, 120)) {
+		t.Fatal("cache served the wrong contents")
+	}
+	if library.openCount("a") != 2 {
+		t.Errorf("a was downloaded %d times, want the new copy served from the cache", library.openCount("a"))
+	}
+	if stats := c.CacheStats(); stats.Entries != 1 || stats.SizeBytes != 120 {
+		t.Errorf("stats = %+v, want just the new copy", stats)
+	}
+}
+
+func TestCacheStaysUnderMaxSize(t *testing.T) {
+	library := newFakeLibrary()
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		library.put(key, key, key[0], 60+i*10)
+	}
+	library.put("huge", "huge", 'h', 300)
+	c := NewDiskCache(library, t.TempDir(), 200, EvictLeastRecentlyUsed)
+
+	for _, key := range []string{"a", "b", "huge", "c", "d", "a", "e", "huge", "b"} {
+		play(t, c, key)
+
+		stats := c.CacheStats()
+		if stats.SizeBytes > 200 {
+			t.Fatalf("cache holds %d bytes after playing %s, over the 200 allowed", stats.SizeBytes, key)
+		}
+
+		var onDisk int64
+		for _, name := range cacheFiles(t, c) {
+			info, err := os.Stat(filepath.Join(c.dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			onDisk += info.Size()
+		}
+		if onDisk != stats.SizeBytes {
+			t.Fatalf("%d bytes on disk after playing %s, but the cache thinks it holds %d", onDisk, key, stats.SizeBytes)
+		}
+	}
+
+	// a video bigger than the whole cache is never written
+	for _, key := range cachedKeys(c) {
+		if key == "huge" {
+			t.Error("cached a video bigger than the cache")
+		}
+	}
+	if library.openCount("huge") != 2 {
+		t.Errorf("huge was downloaded %d times, want every time", library.openCount("huge"))
+	}
+}
+
+// droppedConnection fails every read, like a connection that was cut
+type droppedConnection struct{}
+
+func (droppedConnection) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestCacheDiscardsInterruptedDownloads(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(key string, contents []byte) io.ReadCloser
+		read func(r io.Reader)
+	}{
+		{
+			"skipped",
+			nil,
+			func(r io.Reader) { _, _ = io.ReadFull(r, make([]byte, 40)) },
+		},
+		{
+			"connection lost",
+			func(key string, contents []byte) io.ReadCloser {
+				return ioutil.NopCloser(io.MultiReader(bytes.NewReader(contents[:40]), droppedConnection{}))
+			},
+			func(r io.Reader) { _, _ = ioutil.ReadAll(r) },
+		},
+		{
+			"shorter than expected",
+			func(key string, contents []byte) io.ReadCloser {
+				return ioutil.NopCloser(bytes.NewReader(contents[:40]))
+			},
+			func(r io.Reader) { _, _ = ioutil.ReadAll(r) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			library := newFakeLibrary()
+			library.put("a", "a1", 'a', 100)
+			library.open = tt.open
+			dir := t.TempDir()
+			c := NewDiskCache(library, dir, 1000, EvictLeastRecentlyUsed)
+
+			buf, err := c.OpenVideo("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.read(buf)
+			_ = buf.Close()
+
+			if keys := cachedKeys(c); len(keys) != 0 {
+				t.Errorf("cache holds %v after an interrupted download, want nothing", keys)
+			}
+			if files := cacheFiles(t, c); len(files) != 0 {
+				t.Errorf("cache directory holds %v, want the partial download removed", files)
+			}
+
+			// nothing turns up after a restart either
+			if stats := NewDiskCache(library, dir, 1000, EvictLeastRecentlyUsed).CacheStats(); stats.Entries != 0 {
+				t.Errorf("reloaded cache has %d entries, want none", stats.Entries)
+			}
+
+			// and the next play downloads it again, and can cache it
+			library.open = nil
+			play(t, c, "a")
+			if keys := cachedKeys(c); len(keys) != 1 || library.openCount("a") != 2 {
+				t.Errorf("cache holds %v after %d downloads, want a cached by the second", keys, library.openCount("a"))
+			}
+		})
+	}
+}
+
+func TestCachedFileClosesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.flv")
+	if err := ioutil.WriteFile(path, []byte("FLV"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := &cachedFile{File: f}
+	// a skip closes the input, and then the streamer closes it again when it is done
+	if err := cached.Close(); err != nil {
+		t.Fatalf("first Close() = %v", err)
+	}
+	if err := cached.Close(); err != nil {
+		t.Fatalf("second Close() = %v, want nil", err)
+	}
+}
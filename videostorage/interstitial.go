@@ -0,0 +1,152 @@
+package videostorage
+
+import (
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultInterstitialRefresh = 24 * time.Hour
+
+// Interstitials is a pool of short clips (idents, bumpers and ad breaks) that play between videos. The pool lives
+// under its own prefix and is kept out of the library, so clips are never picked as videos and don't count as plays.
+type Interstitials struct {
+	sync.Mutex
+
+	Source Source
+	// RefreshPeriod is how long the list of clips is used before the bucket is listed again
+	RefreshPeriod time.Duration
+
+	clients *bucketClients
+	clips   []string
+	listed  time.Time
+}
+
+// InterstitialsFromConfig reads the `interstitials` section of the config. The pool is in `interstitials.bucket`
+// (defaulting to the bucket of the first source) under `interstitials.prefix`. Returns nil if no prefix is set.
+func InterstitialsFromConfig(sources []Source) *Interstitials {
+	source, ok := interstitialSource(sources)
+	if !ok {
+		return nil
+	}
+
+	refresh := defaultInterstitialRefresh
+	if configPeriod := viper.GetInt("video_enumeration_period_minutes"); configPeriod != 0 {
+		refresh = time.Duration(configPeriod) * time.Minute
+	}
+
+	return &Interstitials{
+		Source:        source,
+		RefreshPeriod: refresh,
+		clients:       newBucketClients(session.Must(session.NewSession())),
+	}
+}
+
+// interstitialSource works out where the pool is from the config
+func interstitialSource(sources []Source) (Source, bool) {
+	prefix := viper.GetString("interstitials.prefix")
+	if prefix == "" {
+		return Source{}, false
+	}
+
+	bucket := viper.GetString("interstitials.bucket")
+	if bucket == "" && len(sources) > 0 {
+		bucket = sources[0].Bucket
+	}
+	if bucket == "" {
+		log.Fatal("interstitials.bucket must be set if there are no sources")
+	}
+
+	return NewSource(bucket, prefix, nil, nil, 0), true
+}
+
+// excludeInterstitials keeps the interstitial pool out of any source that would otherwise include it
+func excludeInterstitials(sources []Source) []Source {
+	pool, ok := interstitialSource(sources)
+	if !ok {
+		return sources
+	}
+
+	res := make([]Source, 0, len(sources))
+	for _, curr := range sources {
+		if curr.Bucket == pool.Bucket && (strings.HasPrefix(pool.Prefix, curr.Prefix) || strings.HasPrefix(curr.Prefix, pool.Prefix)) {
+			exclude := append(append([]string{}, curr.Exclude...), pool.Prefix+"*")
+			curr = NewSource(curr.Bucket, curr.Prefix, curr.Include, exclude, curr.Weight)
+		}
+		res = append(res, curr)
+	}
+	return res
+}
+
+// Random picks a clip at random from `folder` inside the pool. Returns false if the folder is empty.
+func (i *Interstitials) Random(folder string) (string, bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.clips == nil || time.Since(i.listed) > i.RefreshPeriod {
+		i.refresh()
+	}
+
+	prefix := i.Source.Prefix + folder
+	candidates := make([]string, 0)
+	for _, curr := range i.clips {
+		if strings.HasPrefix(curr, prefix) {
+			candidates = append(candidates, curr)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// Open starts reading a clip from the pool
+func (i *Interstitials) Open(key string) (io.ReadCloser, error) {
+	return openResumable(i.clients.forBucket(i.Source.Bucket), i.Source.Bucket, key)
+}
+
+// refresh lists the clips in the pool. If listing fails, the previous list is kept. Must be called with the lock held.
+func (i *Interstitials) refresh() {
+	clips := make([]string, 0)
+
+	var continuationToken *string
+	for {
+		lor, err := i.clients.forBucket(i.Source.Bucket).ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(i.Source.Bucket),
+			Prefix:            aws.String(i.Source.Prefix),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			log.WithError(err).WithField("source", i.Source.String()).Warn("could not list interstitials")
+			return
+		}
+
+		for _, curr := range lor.Contents {
+			if i.Source.Contains(i.Source.Bucket, aws.StringValue(curr.Key)) {
+				clips = append(clips, aws.StringValue(curr.Key))
+			}
+		}
+
+		if !aws.BoolValue(lor.IsTruncated) {
+			break
+		}
+		continuationToken = lor.NextContinuationToken
+	}
+
+	i.clips = clips
+	i.listed = time.Now()
+	log.WithFields(log.Fields{
+		"source": i.Source.String(),
+		"clips":  len(clips),
+	}).Info("listed interstitials")
+}
@@ -0,0 +1,332 @@
+package videostorage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// ManifestModeFilter lists the bucket as usual, but only keeps videos that are in the manifest
+	ManifestModeFilter = "filter"
+	// ManifestModeReplace skips listing the sources and looks up each video in the manifest directly
+	ManifestModeReplace = "replace"
+
+	defaultManifestCheckMinutes = 5
+)
+
+// ManifestEntry is a single video listed in a manifest. Everything except the key is optional.
+type ManifestEntry struct {
+	Key      string            `yaml:"key"`
+	Title    string            `yaml:"title"`
+	Weight   float64           `yaml:"weight"`
+	Tags     []string          `yaml:"tags"`
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// manifest is a curated list of videos, kept either in a bucket or in a local file. In replace mode, the videos are
+// looked up in the sources instead of listing them.
+type manifest struct {
+	sync.Mutex
+
+	Bucket string
+	Key    string
+	File   string
+	Mode   string
+
+	etag    string
+	entries []ManifestEntry
+}
+
+// manifestFromConfig reads `s3.manifest`. A manifest object is in `defaultBucket` unless `s3.manifest.bucket` says
+// otherwise. Returns nil if there isn't one.
+func manifestFromConfig(defaultBucket string) *manifest {
+	m := &manifest{
+		Bucket: viper.GetString("s3.manifest.bucket"),
+		Key:    viper.GetString("s3.manifest.key"),
+		File:   viper.GetString("s3.manifest.file"),
+		Mode:   viper.GetString("s3.manifest.mode"),
+	}
+
+	if m.Key == "" && m.File == "" {
+		return nil
+	}
+	if m.Key != "" && m.File != "" {
+		log.Fatal("s3.manifest needs either key or file, not both")
+	}
+	if m.Bucket == "" {
+		m.Bucket = defaultBucket
+	}
+
+	switch m.Mode {
+	case "":
+		m.Mode = ManifestModeFilter
+	case ManifestModeFilter, ManifestModeReplace:
+	default:
+		log.WithField("mode", m.Mode).Fatal("s3.manifest.mode must be filter or replace")
+	}
+
+	return m
+}
+
+func (m *manifest) name() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	return m.File
+}
+
+// currentETag finds out the manifest's version without downloading it. Local files don't have ETags, so a hash of
+// the contents stands in.
+func (m *manifest) currentETag(client *s3.S3) (string, error) {
+	if m.File != "" {
+		contents, err := ioutil.ReadFile(m.File)
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.Sum256(contents)
+		return hex.EncodeToString(hash[:]), nil
+	}
+
+	res, err := client.HeadObject(&s3.HeadObjectInput{
+		Key:    aws.String(m.Key),
+		Bucket: aws.String(m.Bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(res.ETag), nil
+}
+
+// load reads and parses the manifest if it has changed since it was last loaded. If it can't be read, the previous
+// version is kept; an error is only returned if there is no previous version to fall back on.
+func (m *manifest) load(client *s3.S3) error {
+	m.Lock()
+	defer m.Unlock()
+
+	logger := log.WithField("manifest", m.name())
+
+	var contents []byte
+	var etag string
+	var err error
+	if m.File != "" {
+		contents, err = ioutil.ReadFile(m.File)
+		hash := sha256.Sum256(contents)
+		etag = hex.EncodeToString(hash[:])
+	} else {
+		var res *s3.GetObjectOutput
+		res, err = client.GetObject(&s3.GetObjectInput{
+			Key:    aws.String(m.Key),
+			Bucket: aws.String(m.Bucket),
+		})
+		if err == nil {
+			etag = aws.StringValue(res.ETag)
+			contents, err = ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+		}
+	}
+
+	if err == nil && etag == m.etag {
+		return nil
+	}
+
+	var entries []ManifestEntry
+	if err == nil {
+		entries, err = parseManifest(m.name(), contents)
+	}
+	if err != nil {
+		if m.entries == nil {
+			return fmt.Errorf("could not load manifest %s: %v", m.name(), err)
+		}
+		logger.WithError(err).Error("could not load manifest, keeping the previous version")
+		return nil
+	}
+
+	m.etag = etag
+	m.entries = entries
+	logger.WithField("count", len(entries)).Info("loaded manifest")
+	return nil
+}
+
+// loadedETag is the version of the manifest that was last loaded
+func (m *manifest) loadedETag() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.etag
+}
+
+// entry looks up a single key in the manifest
+func (m *manifest) entry(key string) (ManifestEntry, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, curr := range m.entries {
+		if curr.Key == key {
+			return curr, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// byKey indexes the manifest's entries by key
+func (m *manifest) byKey() map[string]ManifestEntry {
+	m.Lock()
+	defer m.Unlock()
+
+	res := make(map[string]ManifestEntry, len(m.entries))
+	for _, curr := range m.entries {
+		res[curr.Key] = curr
+	}
+	return res
+}
+
+// apply fills in a video's details from its manifest entry
+func (e ManifestEntry) apply(v *Video) {
+	if e.Title != "" {
+		v.Title = e.Title
+	}
+	v.Weight = scaleWeight(v.Weight, e.Weight)
+	v.Tags = e.Tags
+	v.Metadata = e.Metadata
+}
+
+// parseManifest reads a manifest in whichever format its name suggests. `.m3u` and `.m3u8` files are playlists;
+// anything else is YAML (which includes JSON), either a list of entries or an object with a `videos` list.
+func parseManifest(name string, contents []byte) ([]ManifestEntry, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u", ".m3u8":
+		return parseM3u(contents), nil
+	}
+
+	var entries []ManifestEntry
+	if err := yaml.Unmarshal(contents, &entries); err != nil {
+		var wrapped struct {
+			Videos []ManifestEntry `yaml:"videos"`
+		}
+		if wrappedErr := yaml.Unmarshal(contents, &wrapped); wrappedErr != nil {
+			return nil, err
+		}
+		entries = wrapped.Videos
+	}
+
+	res := entries[:0]
+	for _, curr := range entries {
+		if curr.Key == "" {
+			log.WithField("manifest", name).Warn("skipping manifest entry without a key")
+			continue
+		}
+		res = append(res, curr)
+	}
+	return res, nil
+}
+
+// parseM3u reads a playlist of keys, one per line. Titles are taken from `#EXTINF` lines and other comments are
+// ignored. Entries can also be `s3://bucket/key` URLs, in which case the bucket is dropped.
+func parseM3u(contents []byte) []ManifestEntry {
+	var res []ManifestEntry
+	title := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if idx := strings.Index(line, ","); idx >= 0 {
+				title = strings.TrimSpace(line[idx+1:])
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			key := line
+			if strings.HasPrefix(key, "s3://") {
+				if idx := strings.Index(key[len("s3://"):], "/"); idx >= 0 {
+					key = key[len("s3://")+idx+1:]
+				}
+			}
+			res = append(res, ManifestEntry{Key: key, Title: title})
+			title = ""
+		}
+	}
+
+	return res
+}
+
+// watchManifest re-enumerates whenever the manifest changes
+func (vs *videoStorage) watchManifest() {
+	period := time.Duration(defaultManifestCheckMinutes) * time.Minute
+	if minutes := viper.GetInt("s3.manifest.check_period_minutes"); minutes != 0 {
+		period = time.Duration(minutes) * time.Minute
+	}
+
+	ticker := time.NewTicker(period)
+	for range ticker.C {
+		etag, err := vs.manifest.currentETag(vs.clients.forBucket(vs.manifest.Bucket))
+		if err != nil {
+			log.WithError(err).WithField("manifest", vs.manifest.name()).Warn("could not check manifest for changes")
+			continue
+		}
+
+		if etag != vs.manifest.loadedETag() {
+			log.WithField("manifest", vs.manifest.name()).Info("manifest changed, re-enumerating")
+			vs.ForceEnumerate()
+		}
+	}
+}
+
+// manifestVideos builds the video list from the manifest, either by filtering `listed` or, in replace mode, by
+// looking up each entry in the sources. In replace mode an entry is only used if it belongs to a source (so it must be
+// a `.flv` under a source's prefix and pass its include and exclude patterns), and it is looked up in each source it
+// belongs to in turn until one has it. Must be called with the manifest loaded.
+func (vs *videoStorage) manifestVideos(listed []Video) []Video {
+	entries := vs.manifest.byKey()
+	res := make([]Video, 0, len(entries))
+
+	if vs.manifest.Mode == ManifestModeFilter {
+		for _, curr := range listed {
+			if entry, ok := entries[curr.Key]; ok {
+				entry.apply(&curr)
+				res = append(res, curr)
+			}
+		}
+		return res
+	}
+
+	for _, entry := range entries {
+		if video, ok := vs.lookupManifestEntry(entry); ok {
+			entry.apply(&video)
+			res = append(res, video)
+		}
+	}
+	return res
+}
+
+// lookupManifestEntry finds a manifest entry in the first source that has it
+func (vs *videoStorage) lookupManifestEntry(entry ManifestEntry) (Video, bool) {
+	video, found, inSource := vs.findVideo(entry.Key, "")
+	if found {
+		return video, true
+	}
+
+	logger := log.WithField("video", entry.Key)
+	if inSource {
+		logger.Warn("skipping manifest entry that isn't in any bucket")
+	} else {
+		logger.Warn("skipping manifest entry that doesn't belong to any source, it must be a .flv under a source's prefix that passes its filters")
+	}
+	return Video{}, false
+}
@@ -0,0 +1,97 @@
+package videostorage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		want     []ManifestEntry
+		wantErr  bool
+	}{
+		{
+			name: "yaml list",
+			file: "manifest.yaml",
+			contents: `
+- key: shows/pilot.flv
+  title: The Pilot
+  weight: 2
+  tags: [drama]
+  metadata:
+    series: Show
+- key: shows/two.flv
+`,
+			want: []ManifestEntry{
+				{Key: "shows/pilot.flv", Title: "The Pilot", Weight: 2, Tags: []string{"drama"}, Metadata: map[string]string{"series": "Show"}},
+				{Key: "shows/two.flv"},
+			},
+		},
+		{
+			name:     "json list",
+			file:     "manifest.json",
+			contents: `[{"key": "a.flv", "title": "A"}, {"key": "b.flv"}]`,
+			want:     []ManifestEntry{{Key: "a.flv", Title: "A"}, {Key: "b.flv"}},
+		},
+		{
+			name:     "videos object",
+			file:     "manifest.json",
+			contents: `{"videos": [{"key": "a.flv"}]}`,
+			want:     []ManifestEntry{{Key: "a.flv"}},
+		},
+		{
+			name:     "entries without a key are skipped",
+			file:     "manifest.yaml",
+			contents: "- title: Nothing\n- key: a.flv\n",
+			want:     []ManifestEntry{{Key: "a.flv"}},
+		},
+		{
+			name:     "playlist by extension",
+			file:     "lineup.M3U8",
+			contents: "#EXTM3U\na.flv\n",
+			want:     []ManifestEntry{{Key: "a.flv"}},
+		},
+		{
+			name:     "not a manifest",
+			file:     "manifest.yaml",
+			contents: "just: [some, yaml",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseManifest(tt.file, []byte(tt.contents))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseM3u(t *testing.T) {
+	contents := `#EXTM3U
+
+#EXTINF:1800,The Pilot
+shows/pilot.flv
+# a comment
+  shows/two.flv  
+#EXTINF:-1,From Elsewhere
+s3://other-bucket/movies/film.flv
+`
+	want := []ManifestEntry{
+		{Key: "shows/pilot.flv", Title: "The Pilot"},
+		{Key: "shows/two.flv"},
+		{Key: "movies/film.flv", Title: "From Elsewhere"},
+	}
+
+	if got := parseM3u([]byte(contents)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+package videostorage
+
+// Picker decides which of the candidate videos to play. Candidates always include play statistics and there is always
+// at least one. Pick is called with the storage's lock held, so implementations don't need to be safe for concurrent
+// use but mustn't call back in to the storage.
+type Picker interface {
+	Pick(candidates []Video) Video
+}
+
+// PlayRecorder can be implemented by a Picker that needs to know what actually played, as opposed to what it picked
+// (picks can be thrown away, or overridden by the queue)
+type PlayRecorder interface {
+	RecordPlay(video Video)
+}
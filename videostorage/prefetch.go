@@ -0,0 +1,90 @@
+package videostorage
+
+import (
+	"bytes"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefetched is a video that has been opened ahead of time, with the start of it already downloaded, so that it can
+// start streaming straight away when its turn comes
+type Prefetched struct {
+	Key string
+
+	source io.ReadCloser
+	head   []byte
+	err    error
+	done   chan struct{}
+}
+
+// Prefetch opens the video in the background and reads up to `size` bytes of it in to memory. Either Open or Discard
+// must be called on the result.
+func Prefetch(storage Storage, key string, size int64) *Prefetched {
+	p := &Prefetched{
+		Key:  key,
+		done: make(chan struct{}),
+	}
+	go p.fill(storage, size)
+	return p
+}
+
+func (p *Prefetched) fill(storage Storage, size int64) {
+	defer close(p.done)
+
+	source, err := storage.OpenVideo(p.Key)
+	if err != nil {
+		p.err = err
+		return
+	}
+	p.source = source
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, source, size); err != nil && err != io.EOF {
+		p.err = err
+		return
+	}
+	p.head = buf.Bytes()
+
+	log.WithFields(log.Fields{
+		"video": p.Key,
+		"bytes": len(p.head),
+	}).Info("prefetched start of next video")
+}
+
+// Open waits for the prefetch to finish, then returns a reader that starts with the prefetched bytes and carries on
+// reading from storage
+func (p *Prefetched) Open() (io.ReadCloser, error) {
+	<-p.done
+
+	if p.err != nil {
+		if p.source != nil {
+			_ = p.source.Close()
+		}
+		return nil, p.err
+	}
+
+	return &prefetchedReader{
+		Reader: io.MultiReader(bytes.NewReader(p.head), p.source),
+		source: p.source,
+	}, nil
+}
+
+// Discard throws the prefetched video away, closing it once the prefetch has finished
+func (p *Prefetched) Discard() {
+	go func() {
+		<-p.done
+		if p.source != nil {
+			_ = p.source.Close()
+		}
+	}()
+}
+
+type prefetchedReader struct {
+	io.Reader
+	source io.ReadCloser
+}
+
+func (r *prefetchedReader) Close() error {
+	return r.source.Close()
+}
@@ -0,0 +1,319 @@
+package videostorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/atomicfile"
+)
+
+const (
+	defaultProbeCacheFile = "probe-cache.json"
+	defaultProbeTimeout   = 2 * time.Minute
+
+	// keyframeSampleSeconds is how much of the start of each video is scanned to measure the keyframe interval
+	keyframeSampleSeconds = 60
+	// probeSaveInterval is the most often the cache is written out while probing, so a big library isn't rewritten
+	// after every video
+	probeSaveInterval = time.Minute
+)
+
+// presignedQuery matches the query string of a URL, which is where a presigned URL keeps its credentials
+var presignedQuery = regexp.MustCompile(`(https?://[^\s?"']+)\?[^\s"']*`)
+
+// ProbeResult is what ffprobe found out about a video
+type ProbeResult struct {
+	DurationSeconds float64   `json:"duration_seconds"`
+	FormatName      string    `json:"format_name"`
+	BitRate         int64     `json:"bit_rate"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	FrameRate       float64   `json:"frame_rate"`
+	VideoCodec      string    `json:"video_codec"`
+	AudioCodec      string    `json:"audio_codec"`
+	AudioSampleRate int       `json:"audio_sample_rate"`
+	ProbedAt        time.Time `json:"probed_at"`
+
+	// KeyframeIntervalSeconds is the longest gap between keyframes near the start of the video
+	KeyframeIntervalSeconds float64 `json:"keyframe_interval_seconds"`
+}
+
+// Prober runs ffprobe against videos and remembers the results. Results are keyed by ETag, so a video is only probed
+// again if its contents change, and are saved to `CacheFile` so they survive restarts. New results are written out
+// at most once every `probeSaveInterval`, and whenever Flush is called.
+type Prober struct {
+	sync.Mutex
+
+	FfprobePath string
+	CacheFile   string
+	Timeout     time.Duration
+
+	results map[string]ProbeResult
+	dirty   bool
+	saved   time.Time
+}
+
+// NewProber builds a prober, loading any results already saved in `cacheFile`
+func NewProber(ffprobePath string, cacheFile string) *Prober {
+	p := &Prober{
+		FfprobePath: ffprobePath,
+		CacheFile:   cacheFile,
+		Timeout:     defaultProbeTimeout,
+		results:     make(map[string]ProbeResult),
+	}
+
+	contents, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", cacheFile).Warn("could not read probe cache")
+		}
+		return p
+	}
+
+	if err := json.Unmarshal(contents, &p.results); err != nil {
+		log.WithError(err).WithField("file", cacheFile).Warn("probe cache is corrupt, starting over")
+		p.results = make(map[string]ProbeResult)
+	}
+
+	log.WithFields(log.Fields{
+		"file":    cacheFile,
+		"entries": len(p.results),
+	}).Info("loaded probe cache")
+	return p
+}
+
+// ProberFromConfig reads the `probe` section of the config. Returns nil if probing is turned off or ffprobe can't be
+// found.
+func ProberFromConfig() *Prober {
+	if viper.IsSet("probe.enabled") && !viper.GetBool("probe.enabled") {
+		log.Info("video probing disabled")
+		return nil
+	}
+
+	ffprobePath := viper.GetString("probe.ffprobe_path")
+	if ffprobePath == "" {
+		ffprobePath = "ffprobe"
+	}
+	if _, err := exec.LookPath(ffprobePath); err != nil {
+		log.WithError(err).WithField("path", ffprobePath).Warn("could not find ffprobe, video durations will be unknown")
+		return nil
+	}
+
+	cacheFile := viper.GetString("probe.cache_file")
+	if cacheFile == "" {
+		cacheFile = defaultProbeCacheFile
+	}
+
+	p := NewProber(ffprobePath, cacheFile)
+	if timeout := viper.GetInt("probe.timeout_seconds"); timeout != 0 {
+		p.Timeout = time.Duration(timeout) * time.Second
+	}
+	return p
+}
+
+// Cached returns the saved result for an ETag, if there is one
+func (p *Prober) Cached(etag string) (ProbeResult, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	res, ok := p.results[etag]
+	return res, ok
+}
+
+// Probe runs ffprobe on `url` and saves the result under `etag`. ffprobe only reads as much of the file as it needs,
+// which for FLV is usually just the start.
+func (p *Prober) Probe(url string, etag string) (ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.FfprobePath,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		url,
+	)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ProbeResult{}, fmt.Errorf("ffprobe timed out after %s", p.Timeout)
+	}
+	if err != nil {
+		return ProbeResult{}, fmt.Errorf("ffprobe failed: %v: %s", err, redactURL(strings.TrimSpace(stderr.String()), url))
+	}
+
+	res, err := parseProbeOutput(output)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	if res.VideoCodec != "" {
+		interval, err := p.measureKeyframeInterval(ctx, url)
+		if err != nil {
+			log.WithError(err).Warn("could not measure keyframe interval")
+		}
+		res.KeyframeIntervalSeconds = interval
+	}
+
+	p.Lock()
+	p.results[etag] = res
+	p.dirty = true
+	due := time.Since(p.saved) > probeSaveInterval
+	p.Unlock()
+
+	if due {
+		p.Flush()
+	}
+
+	return res, nil
+}
+
+// Flush writes out any results that haven't been saved yet
+func (p *Prober) Flush() {
+	p.Lock()
+	dirty := p.dirty
+	p.Unlock()
+	if !dirty {
+		return
+	}
+
+	if err := p.save(); err != nil {
+		log.WithError(err).WithField("file", p.CacheFile).Warn("could not save probe cache")
+	}
+}
+
+// measureKeyframeInterval finds the longest gap between keyframes in the first minute or so of the video
+func (p *Prober) measureKeyframeInterval(ctx context.Context, url string) (float64, error) {
+	cmd := exec.CommandContext(ctx, p.FfprobePath,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-read_intervals", fmt.Sprintf("%%+%d", keyframeSampleSeconds),
+		"-show_entries", "frame=best_effort_timestamp_time",
+		"-of", "csv=p=0",
+		url,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var longest float64
+	last := -1.0
+	for _, line := range strings.Split(string(output), "\n") {
+		timestamp, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(line), ","), 64)
+		if err != nil {
+			continue
+		}
+		if last >= 0 && timestamp-last > longest {
+			longest = timestamp - last
+		}
+		last = timestamp
+	}
+
+	return longest, nil
+}
+
+// save writes the cache out, replacing the old copy atomically so a crash never leaves it half written
+func (p *Prober) save() error {
+	p.Lock()
+	contents, err := json.Marshal(p.results)
+	p.dirty = false
+	p.saved = time.Now()
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(p.CacheFile, contents, 0644)
+}
+
+// redactURL strips the presigned `url` out of ffprobe's output before it ends up in errors and logs, since anyone
+// holding it can download the video until it expires
+func redactURL(text string, url string) string {
+	if url != "" {
+		text = strings.ReplaceAll(text, url, "<presigned url>")
+	}
+	return presignedQuery.ReplaceAllString(text, "$1?<redacted>")
+}
+
+// parseProbeOutput pulls the interesting bits out of ffprobe's JSON output. ffprobe reports most numbers as strings.
+func parseProbeOutput(output []byte) (ProbeResult, error) {
+	var payload struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType    string `json:"codec_type"`
+			CodecName    string `json:"codec_name"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+			SampleRate   string `json:"sample_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &payload); err != nil {
+		return ProbeResult{}, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+
+	res := ProbeResult{
+		FormatName: payload.Format.FormatName,
+		ProbedAt:   time.Now(),
+	}
+	res.DurationSeconds, _ = strconv.ParseFloat(payload.Format.Duration, 64)
+	res.BitRate, _ = strconv.ParseInt(payload.Format.BitRate, 10, 64)
+
+	for _, curr := range payload.Streams {
+		switch curr.CodecType {
+		case "video":
+			if res.VideoCodec != "" {
+				continue
+			}
+			res.VideoCodec = curr.CodecName
+			res.Width = curr.Width
+			res.Height = curr.Height
+			res.FrameRate = parseFrameRate(curr.AvgFrameRate)
+		case "audio":
+			if res.AudioCodec != "" {
+				continue
+			}
+			res.AudioCodec = curr.CodecName
+			res.AudioSampleRate, _ = strconv.Atoi(curr.SampleRate)
+		}
+	}
+
+	return res, nil
+}
+
+// parseFrameRate turns ffprobe's fractional frame rates like `30000/1001` in to a number
+func parseFrameRate(rate string) float64 {
+	parts := strings.SplitN(rate, "/", 2)
+	num, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || len(parts) == 1 {
+		return num
+	}
+
+	den, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
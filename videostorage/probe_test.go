@@ -0,0 +1,32 @@
+package videostorage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	url := "https://videos.s3.amazonaws.com/a.flv?X-Amz-Credential=AKIA%2Fus-east-1&X-Amz-Signature=abc123"
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"exact url", url + ": Server returned 403 Forbidden", "<presigned url>: Server returned 403 Forbidden"},
+		{"reworded url", "could not open https://videos.s3.amazonaws.com/a.flv?X-Amz-Signature=abc123 here", "could not open https://videos.s3.amazonaws.com/a.flv?<redacted> here"},
+		{"nothing to redact", "Invalid data found when processing input", "Invalid data found when processing input"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactURL(tt.text, url)
+			if got != tt.want {
+				t.Errorf("redactURL() = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, "abc123") {
+				t.Errorf("redactURL() leaked the signature: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package videostorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// regionLookupTimeout is how long finding out which region a bucket is in may take
+	regionLookupTimeout = 30 * time.Second
+	// regionRetryAfter is how long the default client is used for a bucket whose region couldn't be found before
+	// trying again
+	regionRetryAfter = time.Minute
+	// defaultRegionHint is asked where a bucket is when no region is configured
+	defaultRegionHint = "us-east-1"
+)
+
+// bucketClients hands out an S3 client for each bucket, talking to the region the bucket is actually in, so sources
+// can be spread across regions. Each bucket's region is looked up the first time it is needed, without holding up
+// requests for other buckets. With a custom endpoint (an S3-compatible store rather than AWS) every bucket shares the
+// one client.
+type bucketClients struct {
+	sync.Mutex
+
+	session  *session.Session
+	fallback *s3.S3
+	buckets  map[string]*s3.S3
+	regions  map[string]*s3.S3
+	// lookups are the region lookups in progress, closed when they finish
+	lookups map[string]chan struct{}
+	// failed is when each bucket whose region couldn't be found may be looked up again
+	failed map[string]time.Time
+
+	// lookupRegion finds the region of a bucket, and can be swapped out in tests
+	lookupRegion func(bucket string) (string, error)
+}
+
+func newBucketClients(sess *session.Session) *bucketClients {
+	c := &bucketClients{
+		session:  sess,
+		fallback: s3.New(sess),
+		buckets:  make(map[string]*s3.S3),
+		regions:  make(map[string]*s3.S3),
+		lookups:  make(map[string]chan struct{}),
+		failed:   make(map[string]time.Time),
+	}
+	c.lookupRegion = c.getBucketRegion
+	return c
+}
+
+// forBucket returns the client for `bucket`. If its region can't be found, the default client is used for a while and
+// requests will most likely fail with a redirect error that says which region to use. Only one lookup per bucket
+// runs at a time; anyone else after the same bucket waits for it.
+func (c *bucketClients) forBucket(bucket string) *s3.S3 {
+	if aws.StringValue(c.session.Config.Endpoint) != "" {
+		return c.fallback
+	}
+
+	for {
+		c.Lock()
+		if client, ok := c.buckets[bucket]; ok {
+			c.Unlock()
+			return client
+		}
+		if retry, ok := c.failed[bucket]; ok && time.Now().Before(retry) {
+			c.Unlock()
+			return c.fallback
+		}
+		if done, ok := c.lookups[bucket]; ok {
+			c.Unlock()
+			<-done
+			continue
+		}
+
+		done := make(chan struct{})
+		c.lookups[bucket] = done
+		c.Unlock()
+
+		c.lookup(bucket)
+
+		c.Lock()
+		delete(c.lookups, bucket)
+		c.Unlock()
+		close(done)
+	}
+}
+
+// lookup finds the region of `bucket` and records the client to use for it, or when to try again
+func (c *bucketClients) lookup(bucket string) {
+	region, err := c.lookupRegion(bucket)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err != nil {
+		log.WithError(err).WithField("bucket", bucket).Warn("could not find bucket region, using the default for now")
+		c.failed[bucket] = time.Now().Add(regionRetryAfter)
+		return
+	}
+	delete(c.failed, bucket)
+
+	client, ok := c.regions[region]
+	if !ok {
+		client = s3.New(c.session, aws.NewConfig().WithRegion(region))
+		c.regions[region] = client
+	}
+	c.buckets[bucket] = client
+
+	log.WithFields(log.Fields{
+		"bucket": bucket,
+		"region": region,
+	}).Info("found bucket region")
+}
+
+func (c *bucketClients) getBucketRegion(bucket string) (string, error) {
+	hint := aws.StringValue(c.session.Config.Region)
+	if hint == "" {
+		hint = defaultRegionHint
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), regionLookupTimeout)
+	defer cancel()
+	return s3manager.GetBucketRegion(ctx, c.session, bucket, hint)
+}
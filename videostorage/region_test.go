@@ -0,0 +1,96 @@
+package videostorage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func awsClients(lookup func(bucket string) (string, error)) *bucketClients {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	c := newBucketClients(sess)
+	c.lookupRegion = lookup
+	return c
+}
+
+func TestRegionLookedUpOnce(t *testing.T) {
+	var lookups int32
+	release := make(chan struct{})
+	c := awsClients(func(bucket string) (string, error) {
+		atomic.AddInt32(&lookups, 1)
+		if bucket == "slow" {
+			<-release
+		}
+		return "eu-west-1", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if region := aws.StringValue(c.forBucket("slow").Config.Region); region != "eu-west-1" {
+				t.Errorf("client is for %s, want eu-west-1", region)
+			}
+		}()
+	}
+
+	// a slow lookup doesn't hold up other buckets
+	done := make(chan struct{})
+	go func() {
+		c.forBucket("fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup for one bucket waited on another")
+	}
+
+	close(release)
+	wg.Wait()
+	if got := atomic.LoadInt32(&lookups); got != 2 {
+		t.Errorf("%d lookups, want one per bucket", got)
+	}
+	if c.forBucket("slow") != c.forBucket("fast") {
+		t.Error("buckets in the same region got different clients")
+	}
+}
+
+func TestRegionRetriedAfterFailure(t *testing.T) {
+	var lookups int32
+	c := awsClients(func(bucket string) (string, error) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			return "", errors.New("network is down")
+		}
+		return "eu-west-1", nil
+	})
+
+	if c.forBucket("videos") != c.fallback {
+		t.Fatal("failed lookup didn't use the default client")
+	}
+	if c.forBucket("videos") != c.fallback || atomic.LoadInt32(&lookups) != 1 {
+		t.Fatal("failed lookup was retried straight away")
+	}
+
+	// pretend a minute has gone by
+	c.Lock()
+	c.failed["videos"] = time.Now().Add(-time.Second)
+	c.Unlock()
+
+	if region := aws.StringValue(c.forBucket("videos").Config.Region); region != "eu-west-1" {
+		t.Errorf("client is for %s after the retry, want eu-west-1", region)
+	}
+	if atomic.LoadInt32(&lookups) != 2 {
+		t.Errorf("%d lookups, want 2", lookups)
+	}
+}
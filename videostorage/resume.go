@@ -0,0 +1,185 @@
+package videostorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultReadRetries = 5
+	resumeBaseDelay    = 500 * time.Millisecond
+)
+
+// resumableReader reads an S3 object, picking up where it left off with a ranged GetObject if the connection drops
+// part way through. Retries are pinned to the ETag of the first response so a re-uploaded object is never spliced
+// together with the old one, and a resumed response must start exactly where the last one stopped. Only consecutive
+// failures count against the retry limit.
+type resumableReader struct {
+	sync.Mutex
+
+	client *s3.S3
+	bucket string
+	key    string
+	etag   string
+	// size is -1 if S3 didn't say how big the object is, in which case a connection that is cut cleanly can't be told
+	// apart from the end of the object
+	size       int64
+	maxRetries int
+	baseDelay  time.Duration
+
+	body    io.ReadCloser
+	offset  int64
+	retries int
+	closed  bool
+}
+
+// openResumable starts reading an object from S3
+func openResumable(client *s3.S3, bucket string, key string) (io.ReadCloser, error) {
+	res, err := client.GetObject(&s3.GetObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetries := defaultReadRetries
+	if viper.IsSet("s3.read_retries") {
+		maxRetries = viper.GetInt("s3.read_retries")
+	}
+
+	size := int64(-1)
+	if res.ContentLength != nil {
+		size = *res.ContentLength
+	} else {
+		log.WithField("video", key).Debug("video size unknown, a download cut short may not be noticed")
+	}
+
+	return &resumableReader{
+		client:     client,
+		bucket:     bucket,
+		key:        key,
+		etag:       aws.StringValue(res.ETag),
+		size:       size,
+		maxRetries: maxRetries,
+		baseDelay:  resumeBaseDelay,
+		body:       res.Body,
+	}, nil
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		r.Lock()
+		body := r.body
+		r.Unlock()
+
+		n, err := body.Read(p)
+
+		r.Lock()
+		r.offset += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+		// a clean EOF before the end of the object means the connection was cut
+		if err == io.EOF && r.size >= 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF || r.closed {
+			r.Unlock()
+			return n, err
+		}
+		r.Unlock()
+
+		if resumeErr := r.resume(err); resumeErr != nil {
+			return n, resumeErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume re-opens the object from the current offset after `cause` broke the connection, backing off between
+// attempts. Gives up once it has retried too many times in a row, straight away if the object has changed, and if
+// the response doesn't start at the offset asked for, since carrying on would corrupt the video.
+func (r *resumableReader) resume(cause error) error {
+	logger := log.WithFields(log.Fields{
+		"video":  r.key,
+		"offset": r.offset,
+	})
+
+	for {
+		r.Lock()
+		if r.closed {
+			r.Unlock()
+			return cause
+		}
+		if r.retries >= r.maxRetries {
+			r.Unlock()
+			logger.WithError(cause).Error("giving up resuming video download")
+			return cause
+		}
+		r.retries++
+		attempt := r.retries
+		offset := r.offset
+		r.Unlock()
+
+		logger.WithError(cause).WithField("attempt", attempt).Warn("video download interrupted, resuming")
+		time.Sleep(r.baseDelay * time.Duration(1<<uint(attempt-1)))
+
+		res, err := r.client.GetObject(&s3.GetObjectInput{
+			Key:     aws.String(r.key),
+			Bucket:  aws.String(r.bucket),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-", offset)),
+			IfMatch: aws.String(r.etag),
+		})
+		if err != nil {
+			var reqErr awserr.RequestFailure
+			if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusPreconditionFailed {
+				logger.Error("video changed while it was being downloaded, giving up")
+				return fmt.Errorf("video changed during download: %v", err)
+			}
+			cause = err
+			continue
+		}
+
+		var start int64
+		if _, err := fmt.Sscanf(aws.StringValue(res.ContentRange), "bytes %d-", &start); err != nil || start != offset {
+			_ = res.Body.Close()
+			logger.WithField("content_range", aws.StringValue(res.ContentRange)).Error("resumed download doesn't start where it left off, giving up")
+			return fmt.Errorf("resumed download of %s at byte %d got content range %q", r.key, offset, aws.StringValue(res.ContentRange))
+		}
+
+		r.Lock()
+		_ = r.body.Close()
+		r.body = res.Body
+		closed := r.closed
+		r.Unlock()
+
+		if closed {
+			_ = res.Body.Close()
+			return cause
+		}
+		return nil
+	}
+}
+
+// Close closes the current connection, which also stops any retries
+func (r *resumableReader) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closed = true
+	return r.body.Close()
+}
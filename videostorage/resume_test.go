@@ -0,0 +1,196 @@
+package videostorage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// flakyObject is a stand-in for S3 serving one object over a connection that can be cut part way through. `respond`
+// decides what each GET does, given how many came before it.
+type flakyObject struct {
+	sync.Mutex
+
+	contents []byte
+	etag     string
+	ranges   []string
+	respond  func(w http.ResponseWriter, r *http.Request, request int)
+}
+
+func (o *flakyObject) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.Lock()
+	request := len(o.ranges)
+	o.ranges = append(o.ranges, r.Header.Get("Range"))
+	o.Unlock()
+
+	o.respond(w, r, request)
+}
+
+// serve sends the object from `start`, cutting the connection after `limit` bytes if limit is positive
+func (o *flakyObject) serve(w http.ResponseWriter, r *http.Request, start int, limit int) {
+	if match := r.Header.Get("If-Match"); match != "" && match != `"`+o.etag+`"` {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+		return
+	}
+
+	w.Header().Set("ETag", `"`+o.etag+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.contents)-start))
+	status := http.StatusOK
+	if start > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(o.contents)-1, len(o.contents)))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	body := o.contents[start:]
+	if limit > 0 && limit < len(body) {
+		// returning before the promised length is written makes the server drop the connection
+		body = body[:limit]
+	}
+	_, _ = w.Write(body)
+}
+
+// rangeStart is where a `bytes=N-` range header asks to start
+func rangeStart(r *http.Request) int {
+	start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+	return start
+}
+
+func openFlaky(t *testing.T, object *flakyObject, maxRetries int) *resumableReader {
+	t.Helper()
+
+	server := httptest.NewServer(object)
+	t.Cleanup(server.Close)
+
+	// no retries in the SDK, so every failure reaches the reader
+	client := s3.New(testSession(server.URL), aws.NewConfig().WithMaxRetries(0))
+	rc, err := openResumable(client, "bucket", "video.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rc.Close() })
+
+	r := rc.(*resumableReader)
+	r.maxRetries = maxRetries
+	r.baseDelay = time.Millisecond
+	return r
+}
+
+func testContents() []byte {
+	return bytes.Repeat([]byte("0123456789"), 10000)
+}
+
+func TestResumeAtOffset(t *testing.T) {
+	object := &flakyObject{contents: testContents(), etag: "v1"}
+	object.respond = func(w http.ResponseWriter, r *http.Request, request int) {
+		// every response is cut short after 30000 bytes
+		object.serve(w, r, rangeStart(r), 30000)
+	}
+
+	got, err := ioutil.ReadAll(openFlaky(t, object, 3))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, object.contents) {
+		t.Fatalf("read %d bytes that don't match the object", len(got))
+	}
+
+	want := []string{"", "bytes=30000-", "bytes=60000-", "bytes=90000-"}
+	if strings.Join(object.ranges, ",") != strings.Join(want, ",") {
+		t.Errorf("requested ranges %q, want %q", object.ranges, want)
+	}
+}
+
+func TestResumeFailsWhenObjectChanges(t *testing.T) {
+	object := &flakyObject{contents: testContents(), etag: "v1"}
+	object.respond = func(w http.ResponseWriter, r *http.Request, request int) {
+		if request == 0 {
+			object.serve(w, r, 0, 30000)
+			return
+		}
+		// re-uploaded in the meantime
+		object.etag = "v2"
+		object.serve(w, r, rangeStart(r), 0)
+	}
+
+	_, err := ioutil.ReadAll(openFlaky(t, object, 3))
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("read error = %v, want the video to have changed", err)
+	}
+	if len(object.ranges) != 2 {
+		t.Errorf("made %d requests, want no retries once the object changed", len(object.ranges))
+	}
+}
+
+func TestResumeGivesUp(t *testing.T) {
+	object := &flakyObject{contents: testContents(), etag: "v1"}
+	object.respond = func(w http.ResponseWriter, r *http.Request, request int) {
+		if request == 0 {
+			object.serve(w, r, 0, 30000)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	got, err := ioutil.ReadAll(openFlaky(t, object, 2))
+	if err == nil {
+		t.Fatal("read succeeded, want it to give up")
+	}
+	if len(got) != 30000 {
+		t.Errorf("read %d bytes, want the 30000 sent before the connection was cut", len(got))
+	}
+	if len(object.ranges) != 3 {
+		t.Errorf("made %d requests, want the first and 2 retries", len(object.ranges))
+	}
+}
+
+func TestResumeRejectsIgnoredRange(t *testing.T) {
+	object := &flakyObject{contents: testContents(), etag: "v1"}
+	object.respond = func(w http.ResponseWriter, r *http.Request, request int) {
+		if request == 0 {
+			object.serve(w, r, 0, 30000)
+			return
+		}
+		// a proxy that ignores the range sends the whole object again
+		object.serve(w, r, 0, 0)
+	}
+
+	got, err := ioutil.ReadAll(openFlaky(t, object, 3))
+	if err == nil {
+		t.Fatal("read succeeded, want the mismatched range to be refused")
+	}
+	if len(got) != 30000 {
+		t.Errorf("read %d bytes, want nothing past the cut", len(got))
+	}
+}
+
+func TestUnknownSize(t *testing.T) {
+	object := &flakyObject{contents: testContents(), etag: "v1"}
+	object.respond = func(w http.ResponseWriter, r *http.Request, request int) {
+		// flushing before the body is written sends it chunked, without a Content-Length
+		w.Header().Set("ETag", `"`+object.etag+`"`)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(object.contents)
+	}
+
+	r := openFlaky(t, object, 3)
+	if r.size != -1 {
+		t.Fatalf("size = %d, want -1 for unknown", r.size)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, object.contents) {
+		t.Errorf("read %d bytes with error %v, want the whole object", len(got), err)
+	}
+}
@@ -1,8 +1,9 @@
 package videostorage
 
 import (
+	"fmt"
 	"io"
-	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -10,6 +11,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"github.com/lthummus/bucket-stream/notifier"
+
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -18,26 +22,68 @@ import (
 type videoStorage struct {
 	sync.Mutex
 
-	bucket     string
-	client     *s3.S3
+	sources    []Source
+	clients    *bucketClients
 	downloader *s3manager.Downloader
 
-	videos     *[]string
+	videos     *[]Video
+	videoIndex map[string]int
 	videoCount int
+	plays      map[string]*playRecord
+
+	picker       Picker
+	manifest     *manifest
+	extras       *extraMetadata
+	prober       *Prober
+	requirements Requirements
+	validateLock sync.Mutex
+	quarantine   bool
+	invalid      map[string][]string
+	unprobed     map[string]string
+	sequencers   map[string]string
+
+	// enumerations are run one at a time by a single goroutine, started on the first request
+	enumerateOnce     sync.Once
+	enumerateRequests chan chan struct{}
+
+	notifier notifier.Notifier
+}
+
+// playRecord tracks how often a video has been played. These are kept separately from the video list so they survive
+// re-enumeration.
+type playRecord struct {
+	count      int
+	lastPlayed time.Time
 }
 
 var _ Storage = &videoStorage{}
 
-// New constructs a new video storage that reads from an S3 bucket given by parameter. This constructor will
-// construct the struct as well as kick off an update thread that periodically polls the S3 bucket for videos.
-// Any object without the .flv extension is ignored. The polling period defaults to once every 24 hours, but can
-// be overridden by the VIDEO_ENUMERATION_PERIOD_MINUTES environment variable
-func New(bucket string) *videoStorage {
-	manager := s3.New(session.Must(session.NewSession()))
+// New constructs a new video storage that reads from the given sources, which are merged in to one library. This
+// constructor will construct the struct as well as kick off an update thread that periodically polls the sources for
+// videos. Any object without the .flv extension is ignored. The polling period defaults to once every 24 hours, but can
+// be overridden by the VIDEO_ENUMERATION_PERIOD_MINUTES environment variable. If ffprobe is available, the library is
+// probed and validated in the background after each enumeration. `p` decides which video plays when one is picked at
+// random.
+func New(sources []Source, p Picker) *videoStorage {
+	clients := newBucketClients(session.Must(session.NewSession()))
 	vs := &videoStorage{
-		bucket:     bucket,
-		client:     manager,
-		downloader: s3manager.NewDownloaderWithClient(manager),
+		sources:    sources,
+		clients:    clients,
+		downloader: s3manager.NewDownloaderWithClient(clients.fallback),
+		plays:      make(map[string]*playRecord),
+		picker:     p,
+		manifest:   manifestFromConfig(sources[0].Bucket),
+		extras: &extraMetadata{
+			Sidecars:   viper.GetBool("s3.sidecars"),
+			WeightTag:  viper.GetString("s3.weight_tag"),
+			sidecars:   make(map[string]cachedSidecar),
+			tagWeights: make(map[string]float64),
+		},
+		prober:       ProberFromConfig(),
+		requirements: RequirementsFromConfig(),
+		quarantine:   !viper.IsSet("validation.quarantine") || viper.GetBool("validation.quarantine"),
+		invalid:      make(map[string][]string),
+		unprobed:     make(map[string]string),
 	}
 
 	videoEnumerationPeriodMinutes := 24 * 60
@@ -46,15 +92,25 @@ func New(bucket string) *videoStorage {
 		videoEnumerationPeriodMinutes = configPeriod
 	}
 
+	names := make([]string, 0, len(sources))
+	for _, curr := range sources {
+		names = append(names, curr.String())
+	}
 	log.WithFields(log.Fields{
-		"bucket":                bucket,
+		"sources":               names,
 		"update_period_minutes": videoEnumerationPeriodMinutes,
 	}).Info("initializing update thread")
 
 	vs.ForceEnumerate()
+	if vs.manifest != nil {
+		if vs.videos == nil {
+			log.WithField("manifest", vs.manifest.name()).Fatal("could not load manifest")
+		}
+		go vs.watchManifest()
+	}
 
 	go func() {
-		log.WithField("bucket", vs.bucket).Info("starting update background thread")
+		log.Info("starting update background thread")
 		updateTicker := time.NewTicker(time.Duration(videoEnumerationPeriodMinutes) * time.Minute)
 
 		for {
@@ -66,13 +122,127 @@ func New(bucket string) *videoStorage {
 	return vs
 }
 
-func (vs *videoStorage) PickVideo() (string, io.ReadCloser) {
+// SetNotifier sets the notifier that is told about each enumeration and whether it changed the set of videos
+func (vs *videoStorage) SetNotifier(n notifier.Notifier) {
 	vs.Lock()
-	winnerIdx := rand.Intn(vs.videoCount)
-	winnerVideo := (*vs.videos)[winnerIdx]
-	vs.Unlock()
+	defer vs.Unlock()
+
+	vs.notifier = n
+}
+
+func (vs *videoStorage) PickVideo() (string, io.ReadCloser, error) {
+	winner, ok := vs.ChooseVideo(func(Video) bool { return true })
+	if !ok {
+		// a video known to be bad would break the stream, so nothing plays until something valid turns up
+		vs.Lock()
+		defer vs.Unlock()
+		if vs.videoCount == 0 {
+			return "", nil, ErrNoVideos
+		}
+		return "", nil, ErrAllQuarantined
+	}
+
+	buf, err := vs.getBuffer(winner.Key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return winner.Key, buf, nil
+}
+
+// ChooseVideo never picks a video that failed validation if quarantine is turned on
+func (vs *videoStorage) ChooseVideo(match func(Video) bool) (Video, bool) {
+	vs.Lock()
+	defer vs.Unlock()
+
+	if vs.videos == nil {
+		return Video{}, false
+	}
+
+	var candidates []Video
+	for _, curr := range *vs.videos {
+		if _, invalid := vs.invalid[curr.Key]; (!invalid || !vs.quarantine) && match(curr) {
+			candidates = append(candidates, vs.withPlays(curr))
+		}
+	}
+
+	if len(candidates) == 0 {
+		return Video{}, false
+	}
+
+	return vs.picker.Pick(candidates), true
+}
+
+func (vs *videoStorage) OpenVideo(key string) (io.ReadCloser, error) {
+	if !vs.HasVideo(key) {
+		return nil, fmt.Errorf("unknown video: %s", key)
+	}
 
-	return winnerVideo, vs.getBuffer(winnerVideo)
+	return vs.getBuffer(key)
+}
+
+func (vs *videoStorage) HasVideo(key string) bool {
+	vs.Lock()
+	defer vs.Unlock()
+
+	_, ok := vs.videoIndex[key]
+	return ok
+}
+
+func (vs *videoStorage) ListVideos() []Video {
+	vs.Lock()
+	defer vs.Unlock()
+
+	if vs.videos == nil {
+		return []Video{}
+	}
+
+	res := make([]Video, len(*vs.videos))
+	for i, curr := range *vs.videos {
+		res[i] = vs.withPlays(curr)
+	}
+	return res
+}
+
+func (vs *videoStorage) GetVideoInfo(key string) (Video, bool) {
+	vs.Lock()
+	defer vs.Unlock()
+
+	idx, ok := vs.videoIndex[key]
+	if !ok {
+		return Video{}, false
+	}
+
+	return vs.withPlays((*vs.videos)[idx]), true
+}
+
+func (vs *videoStorage) RecordPlay(key string) {
+	vs.Lock()
+	defer vs.Unlock()
+
+	record, ok := vs.plays[key]
+	if !ok {
+		record = &playRecord{}
+		vs.plays[key] = record
+	}
+	record.count++
+	record.lastPlayed = time.Now()
+
+	if recorder, ok := vs.picker.(PlayRecorder); ok {
+		if idx, ok := vs.videoIndex[key]; ok {
+			recorder.RecordPlay(vs.withPlays((*vs.videos)[idx]))
+		}
+	}
+}
+
+// withPlays fills in the play statistics for a video. Must be called with the lock held.
+func (vs *videoStorage) withPlays(v Video) Video {
+	if record, ok := vs.plays[v.Key]; ok {
+		lastPlayed := record.lastPlayed
+		v.PlayCount = record.count
+		v.LastPlayed = &lastPlayed
+	}
+	return v
 }
 
 func (vs *videoStorage) GetVideoCount() int {
@@ -82,32 +252,325 @@ func (vs *videoStorage) GetVideoCount() int {
 	return vs.videoCount
 }
 
-// ForceEnumerate retrieves all the objects in a bucket and keeps track of all the objects with keys ending in .flv. This
-// is designed to be run at construction of the struct + every once in a while (defaults every 24 hours, but can be
-// customized).
+// ForceEnumerate retrieves all the objects in each source and keeps track of all the objects with keys ending in .flv.
+// This is designed to be run at construction of the struct + every once in a while (defaults every 24 hours, but can be
+// customized). It is also run when the manifest changes and by `POST /enumerate`, so enumerations never overlap:
+// requests made while one is running wait for the next, which serves all of them at once. Returns once an
+// enumeration that started after the request has finished.
 func (vs *videoStorage) ForceEnumerate() {
-	log.WithField("bucket", vs.bucket).Info("starting video enumeration")
-	res := make([]string, 0)
+	vs.enumerateOnce.Do(func() {
+		vs.enumerateRequests = make(chan chan struct{})
+		go vs.enumerateWorker()
+	})
+
+	done := make(chan struct{})
+	vs.enumerateRequests <- done
+	<-done
+}
+
+// enumerateWorker runs enumerations as they are asked for, coalescing requests that came in while the last one ran
+func (vs *videoStorage) enumerateWorker() {
+	for first := range vs.enumerateRequests {
+		waiting := []chan struct{}{first}
+	coalesce:
+		for {
+			select {
+			case curr := <-vs.enumerateRequests:
+				waiting = append(waiting, curr)
+			default:
+				break coalesce
+			}
+		}
+
+		if len(waiting) > 1 {
+			log.WithField("requests", len(waiting)).Info("coalescing enumeration requests")
+		}
+		vs.enumerate()
+
+		for _, curr := range waiting {
+			close(curr)
+		}
+	}
+}
+
+// enumerate lists the library and replaces the videos with whatever was found. Only ever run by enumerateWorker.
+func (vs *videoStorage) enumerate() {
+	log.Info("starting video enumeration")
+
+	var res []Video
+	if vs.manifest != nil {
+		if err := vs.manifest.load(vs.clients.forBucket(vs.manifest.Bucket)); err != nil {
+			log.WithError(err).Error("could not load manifest, skipping enumeration")
+			return
+		}
+
+		if vs.manifest.Mode == ManifestModeReplace {
+			res = vs.manifestVideos(nil)
+		} else {
+			res = vs.manifestVideos(vs.listSources())
+		}
+	} else {
+		res = vs.listSources()
+	}
+
+	if vs.prober != nil {
+		for i := range res {
+			if probed, ok := vs.prober.Cached(res[i].ETag); ok {
+				res[i].applyProbe(probed)
+			}
+		}
+	}
+
+	vs.Lock()
+	changed := vs.videos != nil && !sameVideos(*vs.videos, res)
+	vs.videos = &res
+	vs.videoIndex = make(map[string]int, len(res))
+	for i, curr := range res {
+		vs.videoIndex[curr.Key] = i
+	}
+	vs.videoCount = len(res)
+	n := vs.notifier
+	vs.Unlock()
+
+	log.WithFields(log.Fields{
+		"count":   len(res),
+		"changed": changed,
+	}).Info("finished video enumeration")
+
+	if n != nil {
+		n.Notify(notifier.Event{
+			Type:       notifier.EventLibraryEnumerated,
+			VideoCount: len(res),
+		})
+		if changed {
+			n.Notify(notifier.Event{
+				Type:       notifier.EventLibraryChanged,
+				VideoCount: len(res),
+			})
+		}
+	}
+
+	go vs.Validate()
+}
+
+// Validate probes every video that hasn't been probed yet and checks the whole library against the requirements.
+// With `validation.quarantine` on, videos that fail are never picked; otherwise they are only reported. Videos that
+// couldn't be probed (which may just be a network problem) are reported but never quarantined, and are probed again
+// on the next pass. Returns the current list of both. Does nothing if probing is turned off.
+func (vs *videoStorage) Validate() []InvalidVideo {
+	if vs.prober == nil {
+		return vs.InvalidVideos()
+	}
+
+	// only one pass at a time. a pass started while another is running waits, then only has to look at whatever the
+	// first one didn't get to.
+	vs.validateLock.Lock()
+	defer vs.validateLock.Unlock()
+
+	videos := vs.ListVideos()
+	invalid := make(map[string][]string)
+	unprobed := make(map[string]string)
+
+	var pending []Video
+	for _, curr := range videos {
+		if probed, ok := vs.prober.Cached(curr.ETag); ok {
+			if problems := vs.requirements.Check(probed); len(problems) > 0 {
+				invalid[curr.Key] = problems
+			}
+		} else {
+			pending = append(pending, curr)
+		}
+	}
+
+	if len(pending) > 0 {
+		log.WithField("count", len(pending)).Info("probing new videos")
+	}
+	for _, curr := range pending {
+		probed, err := vs.probe(curr)
+		if err != nil {
+			log.WithError(err).WithField("video", curr.Key).Warn("could not probe video, will try again next time")
+			unprobed[curr.Key] = fmt.Sprintf("could not probe: %v", err)
+			continue
+		}
+		if problems := vs.requirements.Check(probed); len(problems) > 0 {
+			invalid[curr.Key] = problems
+		}
+	}
+
+	vs.prober.Flush()
+
+	vs.Lock()
+	vs.invalid = invalid
+	vs.unprobed = unprobed
+	vs.Unlock()
+
+	message := "video failed validation"
+	if vs.quarantine {
+		message = "video failed validation, it will not be picked"
+	}
+	for key, problems := range invalid {
+		log.WithFields(log.Fields{
+			"video":    key,
+			"problems": problems,
+		}).Warn(message)
+	}
+	log.WithFields(log.Fields{
+		"count":    len(videos),
+		"probed":   len(pending) - len(unprobed),
+		"unprobed": len(unprobed),
+		"invalid":  len(invalid),
+	}).Info("finished validating videos")
+
+	return vs.InvalidVideos()
+}
+
+// probe runs ffprobe on a single video and records the results against it
+func (vs *videoStorage) probe(video Video) (ProbeResult, error) {
+	req, _ := vs.clients.forBucket(video.Bucket).GetObjectRequest(&s3.GetObjectInput{
+		Key:    aws.String(video.Key),
+		Bucket: aws.String(video.Bucket),
+	})
+	url, err := req.Presign(vs.prober.Timeout + time.Minute)
+	if err != nil {
+		return ProbeResult{}, fmt.Errorf("could not presign url: %v", err)
+	}
+
+	probed, err := vs.prober.Probe(url, video.ETag)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	vs.Lock()
+	if idx, ok := vs.videoIndex[video.Key]; ok && (*vs.videos)[idx].ETag == video.ETag {
+		(*vs.videos)[idx].applyProbe(probed)
+	}
+	vs.Unlock()
+
+	log.WithFields(log.Fields{
+		"video":       video.Key,
+		"duration":    time.Duration(probed.DurationSeconds * float64(time.Second)).String(),
+		"resolution":  fmt.Sprintf("%dx%d", probed.Width, probed.Height),
+		"video_codec": probed.VideoCodec,
+		"audio_codec": probed.AudioCodec,
+		"bit_rate":    probed.BitRate,
+	}).Info("probed video")
+
+	return probed, nil
+}
+
+// InvalidVideos returns the videos that failed the last validation pass or couldn't be probed, ordered by key
+func (vs *videoStorage) InvalidVideos() []InvalidVideo {
+	vs.Lock()
+	defer vs.Unlock()
+
+	res := make([]InvalidVideo, 0, len(vs.invalid)+len(vs.unprobed))
+	for key, problems := range vs.invalid {
+		if idx, ok := vs.videoIndex[key]; ok {
+			res = append(res, InvalidVideo{vs.withPlays((*vs.videos)[idx]), problems})
+		}
+	}
+	for key, problem := range vs.unprobed {
+		if idx, ok := vs.videoIndex[key]; ok {
+			res = append(res, InvalidVideo{vs.withPlays((*vs.videos)[idx]), []string{problem}})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// listSources lists the videos in every source. If the same key turns up in more than one source, the first source
+// listed in the config wins.
+func (vs *videoStorage) listSources() []Video {
+	res := make([]Video, 0)
+	seen := make(map[string]string)
+
+	// tags can change without anything else about the object changing, so always fetch them again
+	vs.extras.forgetTags()
+
+	for i, source := range vs.sources {
+		videos, err := vs.listSource(source)
+		if err != nil {
+			// one unreachable bucket shouldn't empty its part of the library, so keep what it had until next time
+			videos = vs.sourceVideos(i)
+			log.WithError(err).WithFields(log.Fields{
+				"source": source.String(),
+				"kept":   len(videos),
+			}).Error("could not list source, keeping its videos from the last enumeration")
+		}
+
+		for _, curr := range videos {
+			if bucket, ok := seen[curr.Key]; ok {
+				log.WithFields(log.Fields{
+					"video":   curr.Key,
+					"bucket":  curr.Bucket,
+					"kept_in": bucket,
+				}).Warn("video is in more than one source, ignoring the later one")
+				continue
+			}
+			seen[curr.Key] = curr.Bucket
+			res = append(res, curr)
+		}
+	}
+
+	return res
+}
+
+// sourceVideos returns the videos in the library that came from the source at position `idx`
+func (vs *videoStorage) sourceVideos(idx int) []Video {
+	vs.Lock()
+	defer vs.Unlock()
+
+	var res []Video
+	if vs.videos == nil {
+		return res
+	}
+	for _, curr := range *vs.videos {
+		if vs.sourceIndex(curr.Bucket, curr.Key) == idx {
+			res = append(res, curr)
+		}
+	}
+	return res
+}
+
+// listSource lists every video in a single source, along with anything from sidecars and tags
+func (vs *videoStorage) listSource(source Source) ([]Video, error) {
+	res := make([]Video, 0)
+	sidecars := make(map[string]string)
+	client := vs.clients.forBucket(source.Bucket)
 
 	var continuationToken *string
 	for {
 		log.WithField("continuation_token", continuationToken).Debug("sending listobjects request")
-		lor, err := vs.client.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            &vs.bucket,
+		lor, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(source.Bucket),
+			Prefix:            aws.String(source.Prefix),
 			ContinuationToken: continuationToken,
 		})
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		for _, curr := range lor.Contents {
-			if strings.HasSuffix(*curr.Key, ".flv") {
-				res = append(res, *curr.Key)
+			if source.Contains(source.Bucket, *curr.Key) {
+				res = append(res, Video{
+					Key:          *curr.Key,
+					Bucket:       source.Bucket,
+					Title:        Title(*curr.Key),
+					Size:         aws.Int64Value(curr.Size),
+					LastModified: aws.TimeValue(curr.LastModified),
+					ETag:         strings.Trim(aws.StringValue(curr.ETag), `"`),
+					Weight:       source.Weight,
+				})
+			} else if strings.HasSuffix(*curr.Key, ".json") {
+				sidecars[*curr.Key] = aws.StringValue(curr.ETag)
 			} else {
 				log.WithFields(log.Fields{
-					"bucket": vs.bucket,
+					"bucket": source.Bucket,
 					"key":    *curr.Key,
-				}).Warn("skipping as it is not a valid video")
+				}).Debug("skipping as it is not a valid video or is filtered out")
 			}
 		}
 
@@ -115,27 +578,92 @@ func (vs *videoStorage) ForceEnumerate() {
 			break
 		}
 
-		continuationToken = lor.ContinuationToken
+		continuationToken = lor.NextContinuationToken
 	}
 
-	vs.Lock()
-	defer vs.Unlock()
-	vs.videos = &res
-	vs.videoCount = len(res)
-	log.WithFields(log.Fields{
-		"bucket": vs.bucket,
-		"count":  vs.videoCount,
-	}).Info("finished video enumeration")
+	if vs.extras.enabled() {
+		for i := range res {
+			vs.extras.apply(client, &res[i], sidecars[sidecarKey(res[i].Key)])
+		}
+	}
+
+	return res, nil
 }
 
-// getBuffer pulls the object info for the given key and opens an `io.ReadCloser` for the object
-func (vs *videoStorage) getBuffer(key string) io.ReadCloser {
-	res, err := vs.client.GetObject(&s3.GetObjectInput{
-		Key:    &key,
-		Bucket: &vs.bucket,
-	})
-	if err != nil {
-		log.WithError(err).Fatal("error getting object")
+// findVideo looks `key` up in each source in turn, returning it from the first source that has it. Sources in
+// `skipBucket` aren't checked. inSource is false if the key doesn't belong to any of the sources that were checked.
+func (vs *videoStorage) findVideo(key string, skipBucket string) (video Video, found bool, inSource bool) {
+	logger := log.WithField("video", key)
+
+	for _, source := range vs.sources {
+		if source.Bucket == skipBucket || !source.Contains(source.Bucket, key) {
+			continue
+		}
+		inSource = true
+
+		head, err := vs.clients.forBucket(source.Bucket).HeadObject(&s3.HeadObjectInput{
+			Key:    aws.String(key),
+			Bucket: aws.String(source.Bucket),
+		})
+		if err != nil {
+			logger.WithError(err).WithField("source", source.String()).Debug("video isn't in source")
+			continue
+		}
+
+		return Video{
+			Key:          key,
+			Bucket:       source.Bucket,
+			Title:        Title(key),
+			Size:         aws.Int64Value(head.ContentLength),
+			LastModified: aws.TimeValue(head.LastModified),
+			ETag:         strings.Trim(aws.StringValue(head.ETag), `"`),
+			Weight:       source.Weight,
+		}, true, true
+	}
+
+	return Video{}, false, inSource
+}
+
+// sourceIndex returns the position of the first source an object belongs to, or -1 if it isn't in any of them
+func (vs *videoStorage) sourceIndex(bucket string, key string) int {
+	for i, curr := range vs.sources {
+		if curr.Contains(bucket, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameVideos reports whether both lists contain the same keys, ignoring order
+func sameVideos(a []Video, b []Video) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[string]bool, len(a))
+	for _, curr := range a {
+		seen[curr.Key] = true
 	}
-	return res.Body
+	for _, curr := range b {
+		if !seen[curr.Key] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getBuffer opens an `io.ReadCloser` for the object with the given key, from whichever bucket it was found in. If the
+// connection to S3 drops part way through, the reader resumes from where it left off.
+func (vs *videoStorage) getBuffer(key string) (io.ReadCloser, error) {
+	vs.Lock()
+	idx, ok := vs.videoIndex[key]
+	if !ok {
+		vs.Unlock()
+		return nil, fmt.Errorf("unknown video: %s", key)
+	}
+	bucket := (*vs.videos)[idx].Bucket
+	vs.Unlock()
+
+	return openResumable(vs.clients.forBucket(bucket), bucket, key)
 }
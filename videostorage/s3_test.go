@@ -0,0 +1,180 @@
+package videostorage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstPicker always picks the first candidate
+type firstPicker struct{}
+
+func (firstPicker) Pick(candidates []Video) Video {
+	return candidates[0]
+}
+
+// libraryTest builds storage holding `keys`, without any sources behind it
+func libraryTest(keys ...string) *videoStorage {
+	videos := make([]Video, 0, len(keys))
+	index := make(map[string]int)
+	for i, curr := range keys {
+		videos = append(videos, Video{Key: curr, Bucket: "primary"})
+		index[curr] = i
+	}
+
+	return &videoStorage{
+		videos:     &videos,
+		videoIndex: index,
+		videoCount: len(videos),
+		plays:      make(map[string]*playRecord),
+		picker:     firstPicker{},
+		quarantine: true,
+		invalid:    make(map[string][]string),
+		unprobed:   make(map[string]string),
+	}
+}
+
+func TestChooseVideoSkipsQuarantined(t *testing.T) {
+	vs := libraryTest("bad.flv", "good.flv")
+	vs.invalid["bad.flv"] = []string{"video codec is vp9"}
+
+	if video, ok := vs.ChooseVideo(func(Video) bool { return true }); !ok || video.Key != "good.flv" {
+		t.Errorf("ChooseVideo() = %s, want good.flv", video.Key)
+	}
+
+	vs.quarantine = false
+	if video, ok := vs.ChooseVideo(func(Video) bool { return true }); !ok || video.Key != "bad.flv" {
+		t.Errorf("ChooseVideo() without quarantine = %s, want bad.flv to be a candidate", video.Key)
+	}
+}
+
+func TestPickVideoWithNothingValid(t *testing.T) {
+	vs := libraryTest("bad.flv")
+	vs.invalid["bad.flv"] = []string{"video codec is vp9"}
+
+	if _, _, err := vs.PickVideo(); !errors.Is(err, ErrAllQuarantined) {
+		t.Errorf("PickVideo() = %v, want ErrAllQuarantined", err)
+	}
+
+	empty := libraryTest()
+	if _, _, err := empty.PickVideo(); !errors.Is(err, ErrNoVideos) {
+		t.Errorf("PickVideo() on an empty library = %v, want ErrNoVideos", err)
+	}
+}
+
+// fakeListing is a stand-in for S3 that lists and serves objects, holding each listing for `delay` and keeping track
+// of how many are running at once. It maps bucket/key to the object's contents.
+type fakeListing struct {
+	sync.Mutex
+
+	objects map[string]string
+	delay   time.Duration
+
+	listings   int
+	running    int
+	maxRunning int
+}
+
+func (l *fakeListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if r.URL.Query().Get("list-type") != "2" {
+		l.Lock()
+		contents, ok := l.objects[path]
+		l.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		fmt.Fprint(w, contents)
+		return
+	}
+
+	l.Lock()
+	l.listings++
+	l.running++
+	if l.running > l.maxRunning {
+		l.maxRunning = l.running
+	}
+	var listed strings.Builder
+	for curr := range l.objects {
+		if strings.HasPrefix(curr, path+"/") {
+			fmt.Fprintf(&listed, "<Contents><Key>%s</Key><Size>100</Size><ETag>\"etag\"</ETag>"+
+				"<LastModified>2026-01-02T15:04:05.000Z</LastModified></Contents>", strings.TrimPrefix(curr, path+"/"))
+		}
+	}
+	l.Unlock()
+
+	time.Sleep(l.delay)
+
+	l.Lock()
+	l.running--
+	l.Unlock()
+	fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated>%s</ListBucketResult>", path,
+		listed.String())
+}
+
+// listingTest sets up storage reading from the `videos` bucket, with the S3 stand-in holding `objects`
+func listingTest(t *testing.T, objects map[string]string, delay time.Duration) (*videoStorage, *fakeListing) {
+	t.Helper()
+
+	listing := &fakeListing{objects: objects, delay: delay}
+	server := httptest.NewServer(listing)
+	t.Cleanup(server.Close)
+
+	vs := libraryTest()
+	vs.videos = nil
+	vs.sources = []Source{NewSource("videos", "", nil, nil, 0)}
+	vs.clients = newBucketClients(testSession(server.URL))
+	vs.extras = &extraMetadata{tagWeights: make(map[string]float64)}
+	return vs, listing
+}
+
+func TestForceEnumerateCoalesces(t *testing.T) {
+	vs, listing := listingTest(t, map[string]string{"videos/a.flv": "", "videos/b.flv": ""}, 100*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vs.ForceEnumerate()
+			// every caller sees an enumeration that started after it asked
+			if count := vs.GetVideoCount(); count != 2 {
+				t.Errorf("%d videos after ForceEnumerate returned, want 2", count)
+			}
+		}()
+	}
+	wg.Wait()
+
+	listing.Lock()
+	defer listing.Unlock()
+	if listing.maxRunning != 1 {
+		t.Errorf("%d enumerations ran at once, want 1", listing.maxRunning)
+	}
+	// the first one starts straight away and everything else waits to share the next
+	if listing.listings > 2 {
+		t.Errorf("%d enumerations for 10 requests, want them coalesced in to 2 at most", listing.listings)
+	}
+}
+
+func TestManifestBucket(t *testing.T) {
+	vs, _ := listingTest(t, map[string]string{
+		"videos/a.flv":           "",
+		"videos/b.flv":           "",
+		"videos/manifest.yaml":   "- key: a.flv\n",
+		"config/manifest.yaml":   "- key: b.flv\n",
+		"config/not-a-video.flv": "",
+	}, 0)
+	vs.manifest = &manifest{Bucket: "config", Key: "manifest.yaml", Mode: ManifestModeFilter}
+
+	vs.ForceEnumerate()
+	if videos := vs.ListVideos(); len(videos) != 1 || videos[0].Key != "b.flv" || videos[0].Bucket != "videos" {
+		t.Errorf("library is %+v, want just b.flv from the videos bucket, as listed in the config bucket's manifest", videos)
+	}
+}
@@ -0,0 +1,127 @@
+package videostorage
+
+import (
+	"sort"
+	"strings"
+)
+
+// SearchOptions narrows down a list of videos. All of the fields are optional.
+type SearchOptions struct {
+	// Prefix limits results to keys starting with this string, e.g. a folder like `shows/`
+	Prefix string
+	// Query matches against the key and title, ignoring case
+	Query string
+	// Fuzzy makes Query match any key or title containing its characters in order (so `s1e2` finds `S01E02`), with
+	// results ordered by how good the match is
+	Fuzzy bool
+
+	Offset int
+	Limit  int
+}
+
+// Search filters `videos` according to `opts`, returning one page of results along with the total number of matches.
+// Results are ordered by key unless a fuzzy query is given.
+func Search(videos []Video, opts SearchOptions) ([]Video, int) {
+	type match struct {
+		video Video
+		score int
+	}
+
+	query := strings.ToLower(opts.Query)
+
+	var matches []match
+	for _, curr := range videos {
+		if !strings.HasPrefix(curr.Key, opts.Prefix) {
+			continue
+		}
+
+		if query == "" {
+			matches = append(matches, match{curr, 0})
+			continue
+		}
+
+		key := strings.ToLower(curr.Key)
+		title := strings.ToLower(curr.Title)
+		if opts.Fuzzy {
+			score, ok := fuzzyScore(title, query)
+			if keyScore, keyOk := fuzzyScore(key, query); keyOk && (!ok || keyScore > score) {
+				score, ok = keyScore, true
+			}
+			if ok {
+				matches = append(matches, match{curr, score})
+			}
+		} else if strings.Contains(key, query) || strings.Contains(title, query) {
+			matches = append(matches, match{curr, 0})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].video.Key < matches[j].video.Key
+	})
+
+	total := len(matches)
+	start := opts.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+
+	res := make([]Video, 0, end-start)
+	for _, curr := range matches[start:end] {
+		res = append(res, curr.video)
+	}
+
+	return res, total
+}
+
+// fuzzyScore checks whether every character of `query` appears in `s` in order. Matches score higher when the
+// characters are consecutive or start a word, and lower the more of `s` they skip over.
+func fuzzyScore(s string, query string) (int, bool) {
+	score := 0
+	qi := 0
+	lastMatch := -1
+
+	for si := 0; si < len(s) && qi < len(query); si++ {
+		if s[si] != query[qi] {
+			continue
+		}
+
+		score += 1
+		if lastMatch == si-1 {
+			score += 5
+		}
+		if si == 0 || strings.ContainsRune("/_- .", rune(s[si-1])) {
+			score += 3
+		}
+		if lastMatch >= 0 {
+			score -= si - lastMatch - 1
+		}
+
+		lastMatch = si
+		qi++
+	}
+
+	return score, qi == len(query)
+}
+
+// Folders returns the immediate sub-folders of `prefix`, along with how many videos are somewhere beneath each one
+func Folders(videos []Video, prefix string) map[string]int {
+	res := make(map[string]int)
+	for _, curr := range videos {
+		if !strings.HasPrefix(curr.Key, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(curr.Key, prefix)
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			res[prefix+rest[:idx+1]]++
+		}
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package videostorage
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// extraMetadata fetches details kept next to videos in S3: sidecar files (`show.json` next to `show.flv`, in the same
+// format as a manifest entry) and a weight from an object tag. Sidecars are cached by ETag, so they are only fetched
+// again when they change. Editing an object's tags doesn't change its ETag, so tag weights are cached by bucket and key
+// instead, and fetched again on each enumeration.
+type extraMetadata struct {
+	sync.Mutex
+
+	Sidecars  bool
+	WeightTag string
+
+	sidecars   map[string]cachedSidecar
+	tagWeights map[string]float64
+}
+
+type cachedSidecar struct {
+	etag  string
+	entry ManifestEntry
+}
+
+func (e *extraMetadata) enabled() bool {
+	return e.Sidecars || e.WeightTag != ""
+}
+
+// sidecarKey is where the sidecar for a video would be
+func sidecarKey(key string) string {
+	return strings.TrimSuffix(key, ".flv") + ".json"
+}
+
+// apply fills in a video's details from its sidecar (if `sidecarETag` isn't empty) and weight tag
+func (e *extraMetadata) apply(client *s3.S3, video *Video, sidecarETag string) {
+	if e.Sidecars && sidecarETag != "" {
+		if entry, ok := e.sidecar(client, video.Bucket, sidecarKey(video.Key), sidecarETag); ok {
+			entry.apply(video)
+		}
+	}
+
+	if e.WeightTag != "" {
+		video.Weight = scaleWeight(video.Weight, e.tagWeight(client, *video))
+	}
+}
+
+func (e *extraMetadata) sidecar(client *s3.S3, bucket string, key string, etag string) (ManifestEntry, bool) {
+	e.Lock()
+	cached, ok := e.sidecars[key]
+	e.Unlock()
+	if ok && cached.etag == etag {
+		return cached.entry, true
+	}
+
+	logger := log.WithField("sidecar", key)
+	res, err := client.GetObject(&s3.GetObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		logger.WithError(err).Warn("could not fetch sidecar")
+		return ManifestEntry{}, false
+	}
+	defer res.Body.Close()
+
+	contents, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.WithError(err).Warn("could not read sidecar")
+		return ManifestEntry{}, false
+	}
+
+	var entry ManifestEntry
+	if err := yaml.Unmarshal(contents, &entry); err != nil {
+		logger.WithError(err).Warn("could not parse sidecar")
+		return ManifestEntry{}, false
+	}
+
+	e.Lock()
+	e.sidecars[key] = cachedSidecar{etag, entry}
+	e.Unlock()
+	return entry, true
+}
+
+// tagCacheKey is where a video's tag weight is cached
+func tagCacheKey(bucket string, key string) string {
+	return bucket + "/" + key
+}
+
+// forgetTags drops every cached tag weight, so they are all fetched again
+func (e *extraMetadata) forgetTags() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.tagWeights = make(map[string]float64)
+}
+
+// forgetTag drops the cached tag weight for a single object
+func (e *extraMetadata) forgetTag(bucket string, key string) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.tagWeights, tagCacheKey(bucket, key))
+}
+
+// tagWeight reads the weight tag on a video, returning zero if it doesn't have one
+func (e *extraMetadata) tagWeight(client *s3.S3, video Video) float64 {
+	e.Lock()
+	weight, ok := e.tagWeights[tagCacheKey(video.Bucket, video.Key)]
+	e.Unlock()
+	if ok {
+		return weight
+	}
+
+	res, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Key:    aws.String(video.Key),
+		Bucket: aws.String(video.Bucket),
+	})
+	if err != nil {
+		log.WithError(err).WithField("video", video.Key).Warn("could not fetch video tags")
+		return 0
+	}
+
+	for _, curr := range res.TagSet {
+		if aws.StringValue(curr.Key) != e.WeightTag {
+			continue
+		}
+		weight, err = strconv.ParseFloat(aws.StringValue(curr.Value), 64)
+		if err != nil || weight < 0 {
+			log.WithField("video", video.Key).WithField("tag", aws.StringValue(curr.Value)).Warn("weight tag isn't a positive number")
+			weight = 0
+		}
+	}
+
+	e.Lock()
+	e.tagWeights[tagCacheKey(video.Bucket, video.Key)] = weight
+	e.Unlock()
+	return weight
+}
@@ -0,0 +1,139 @@
+package videostorage
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Source is a place videos are listed from: everything in a bucket under a prefix, optionally narrowed down with glob
+// patterns. In the patterns, `*` matches anything (including slashes) and `?` matches a single character, and they
+// are matched against the whole key.
+type Source struct {
+	Bucket  string
+	Prefix  string
+	Include []string
+	Exclude []string
+	// Weight scales the chance of picking any video from this source. Zero means 1.
+	Weight float64
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+type sourceConfig struct {
+	Bucket  string   `mapstructure:"bucket"`
+	Prefix  string   `mapstructure:"prefix"`
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+	Weight  float64  `mapstructure:"weight"`
+}
+
+// SourcesFromConfig reads `s3.sources`, falling back to the whole of `s3.bucket` if there aren't any. The interstitial
+// pool is excluded from every source.
+func SourcesFromConfig() []Source {
+	var configs []sourceConfig
+	if err := viper.UnmarshalKey("s3.sources", &configs); err != nil {
+		log.WithError(err).Fatal("could not read s3.sources config")
+	}
+
+	if len(configs) == 0 {
+		bucket := viper.GetString("s3.bucket")
+		if bucket == "" {
+			log.Fatal("either s3.bucket or s3.sources must be set")
+		}
+		return excludeInterstitials([]Source{NewSource(bucket, "", nil, nil, 0)})
+	}
+
+	res := make([]Source, 0, len(configs))
+	for _, curr := range configs {
+		if curr.Bucket == "" {
+			log.Fatal("every entry in s3.sources needs a bucket")
+		}
+		res = append(res, NewSource(curr.Bucket, curr.Prefix, curr.Include, curr.Exclude, curr.Weight))
+	}
+	return excludeInterstitials(res)
+}
+
+// NewSource builds a source, compiling its patterns
+func NewSource(bucket string, prefix string, include []string, exclude []string, weight float64) Source {
+	s := Source{
+		Bucket:  bucket,
+		Prefix:  prefix,
+		Include: include,
+		Exclude: exclude,
+		Weight:  weight,
+	}
+
+	for _, curr := range include {
+		s.include = append(s.include, globToRegexp(curr))
+	}
+	for _, curr := range exclude {
+		s.exclude = append(s.exclude, globToRegexp(curr))
+	}
+
+	return s
+}
+
+// Contains reports whether an object belongs to this source. Only `.flv` files are ever videos.
+func (s Source) Contains(bucket string, key string) bool {
+	if bucket != s.Bucket || !strings.HasPrefix(key, s.Prefix) || !strings.HasSuffix(key, ".flv") {
+		return false
+	}
+
+	if len(s.include) > 0 {
+		included := false
+		for _, curr := range s.include {
+			if curr.MatchString(key) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, curr := range s.exclude {
+		if curr.MatchString(key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Source) String() string {
+	return "s3://" + s.Bucket + "/" + s.Prefix
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression
+func globToRegexp(glob string) *regexp.Regexp {
+	var res strings.Builder
+	res.WriteString("^")
+	for _, curr := range glob {
+		switch curr {
+		case '*':
+			res.WriteString(".*")
+		case '?':
+			res.WriteString(".")
+		default:
+			res.WriteString(regexp.QuoteMeta(string(curr)))
+		}
+	}
+	res.WriteString("$")
+	return regexp.MustCompile(res.String())
+}
+
+// scaleWeight multiplies a video's weight by `factor`, treating zero as 1 on both sides
+func scaleWeight(weight float64, factor float64) float64 {
+	if factor <= 0 {
+		return weight
+	}
+	if weight <= 0 {
+		return factor
+	}
+	return weight * factor
+}
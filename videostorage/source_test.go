@@ -0,0 +1,68 @@
+package videostorage
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		key   string
+		match bool
+	}{
+		{"*.flv", "a.flv", true},
+		{"*.flv", "shows/season 1/a.flv", true},
+		{"shows/*", "shows/a/b.flv", true},
+		{"shows/*", "movies/shows/a.flv", false},
+		{"ep?.flv", "ep1.flv", true},
+		{"ep?.flv", "ep10.flv", false},
+		{"ep?.flv", "ep/.flv", true},
+		{"a.flv", "abflv", false},
+		{"[old]*", "[old] a.flv", true},
+		{"[old]*", "o.flv", false},
+		{"a+b.flv", "a+b.flv", true},
+		{"a+b.flv", "aab.flv", false},
+		{"", "", true},
+		{"", "a.flv", false},
+	}
+
+	for _, tt := range tests {
+		if got := globToRegexp(tt.glob).MatchString(tt.key); got != tt.match {
+			t.Errorf("globToRegexp(%q) matching %q = %v, want %v", tt.glob, tt.key, got, tt.match)
+		}
+	}
+}
+
+func TestSourceContains(t *testing.T) {
+	source := NewSource("videos", "shows/", []string{"*/season ?/*", "*special*"}, []string{"*/extras/*", "*.tmp.flv"}, 0)
+
+	tests := []struct {
+		bucket   string
+		key      string
+		contains bool
+	}{
+		{"videos", "shows/a/season 1/e1.flv", true},
+		{"videos", "shows/a/special.flv", true},
+		{"other", "shows/a/season 1/e1.flv", false},
+		{"videos", "movies/a/season 1/e1.flv", false},
+		{"videos", "shows/a/season 1/e1.mp4", false},
+		{"videos", "shows/a/season 1/notes.txt", false},
+		{"videos", "shows/a/e1.flv", false},
+		{"videos", "shows/a/season 12/e1.flv", false},
+		{"videos", "shows/a/season 1/extras/blooper.flv", false},
+		{"videos", "shows/a/special.tmp.flv", false},
+	}
+
+	for _, tt := range tests {
+		if got := source.Contains(tt.bucket, tt.key); got != tt.contains {
+			t.Errorf("Contains(%s, %s) = %v, want %v", tt.bucket, tt.key, got, tt.contains)
+		}
+	}
+
+	// with no patterns, everything under the prefix is in
+	whole := NewSource("videos", "", nil, nil, 0)
+	if !whole.Contains("videos", "anything/at/all.flv") {
+		t.Error("a source without patterns left out a video")
+	}
+	if whole.Contains("videos", "anything/at/all.flv.part") {
+		t.Error("a source without patterns took in something that isn't a .flv")
+	}
+}
@@ -0,0 +1,309 @@
+package videostorage
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lthummus/bucket-stream/notifier"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	defaultQueueWaitSeconds = 20
+	queueErrorDelay         = 5 * time.Second
+)
+
+// s3EventRecord is the part of an S3 event notification we care about
+type s3EventRecord struct {
+	EventName string    `json:"eventName"`
+	EventTime time.Time `json:"eventTime"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			Size      int64  `json:"size"`
+			ETag      string `json:"eTag"`
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// WatchEventQueue starts consuming S3 event notifications from the SQS queue in `s3.event_queue.url`, adding and
+// removing videos as they are uploaded and deleted. Notifications can come straight from S3 or by way of SNS. The
+// periodic full enumeration still runs as a safety net. Does nothing if no queue is configured.
+func (vs *videoStorage) WatchEventQueue() {
+	queueUrl := viper.GetString("s3.event_queue.url")
+	if queueUrl == "" {
+		return
+	}
+
+	config := aws.NewConfig()
+	if endpoint := viper.GetString("s3.event_queue.endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	client := sqs.New(session.Must(session.NewSession()), config)
+
+	waitSeconds := int64(defaultQueueWaitSeconds)
+	if viper.IsSet("s3.event_queue.wait_seconds") {
+		waitSeconds = viper.GetInt64("s3.event_queue.wait_seconds")
+	}
+
+	log.WithField("queue", queueUrl).Info("watching queue for library changes")
+	go func() {
+		for {
+			if err := vs.pollEventQueue(client, queueUrl, waitSeconds); err != nil {
+				log.WithError(err).WithField("queue", queueUrl).Warn("could not receive from event queue")
+				time.Sleep(queueErrorDelay)
+			}
+		}
+	}()
+}
+
+// pollEventQueue waits up to `waitSeconds` for messages on the queue, applies them and deletes them
+func (vs *videoStorage) pollEventQueue(client *sqs.SQS, queueUrl string, waitSeconds int64) error {
+	res, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueUrl),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(waitSeconds),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, curr := range res.Messages {
+		vs.handleEventMessage(aws.StringValue(curr.Body))
+
+		if _, err := client.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueUrl),
+			ReceiptHandle: curr.ReceiptHandle,
+		}); err != nil {
+			log.WithError(err).WithField("queue", queueUrl).Warn("could not delete message from event queue")
+		}
+	}
+	return nil
+}
+
+// handleEventMessage applies every record in an S3 event notification. Messages that aren't S3 events (like the test
+// event S3 sends when notifications are set up) are ignored, as are events older than one already applied to the same
+// object, since SQS doesn't keep them in order.
+func (vs *videoStorage) handleEventMessage(body string) {
+	var payload struct {
+		// set when the notification came through SNS, in which case the S3 event is JSON inside it
+		Message string          `json:"Message"`
+		Records []s3EventRecord `json:"Records"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		log.WithError(err).Warn("could not parse event queue message")
+		return
+	}
+	if payload.Message != "" {
+		if err := json.Unmarshal([]byte(payload.Message), &payload); err != nil {
+			log.WithError(err).Warn("could not parse event queue message")
+			return
+		}
+	}
+
+	changed := false
+	for _, curr := range payload.Records {
+		bucket := curr.S3.Bucket.Name
+
+		// keys in event notifications are URL encoded
+		key, err := url.QueryUnescape(curr.S3.Object.Key)
+		if err != nil {
+			log.WithError(err).WithField("key", curr.S3.Object.Key).Warn("could not decode key in event")
+			continue
+		}
+		source := vs.sourceIndex(bucket, key)
+		if source < 0 {
+			continue
+		}
+		if !vs.newerEvent(bucket, key, curr.S3.Object.Sequencer) {
+			log.WithFields(log.Fields{
+				"video": key,
+				"event": curr.EventName,
+			}).Info("ignoring out of order event")
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(curr.EventName, "ObjectCreated:"):
+			video := Video{
+				Key:          key,
+				Bucket:       bucket,
+				Title:        Title(key),
+				Size:         curr.S3.Object.Size,
+				LastModified: curr.EventTime,
+				ETag:         strings.Trim(curr.S3.Object.ETag, `"`),
+				Weight:       vs.sources[source].Weight,
+			}
+			if !vs.prepareVideo(&video) {
+				continue
+			}
+			changed = vs.addVideo(video) || changed
+		case strings.HasPrefix(curr.EventName, "ObjectRemoved:"):
+			changed = vs.removeVideo(bucket, key) || changed
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	vs.Lock()
+	n := vs.notifier
+	count := vs.videoCount
+	vs.Unlock()
+
+	if n != nil {
+		n.Notify(notifier.Event{
+			Type:       notifier.EventLibraryChanged,
+			VideoCount: count,
+		})
+	}
+	go vs.Validate()
+}
+
+// newerEvent records the sequencer of an event for an object, returning false if an event with a later one has already
+// been seen. Events without a sequencer are always applied.
+func (vs *videoStorage) newerEvent(bucket string, key string, sequencer string) bool {
+	if sequencer == "" {
+		return true
+	}
+
+	vs.Lock()
+	defer vs.Unlock()
+
+	if vs.sequencers == nil {
+		vs.sequencers = make(map[string]string)
+	}
+	object := bucket + "/" + key
+	if last, ok := vs.sequencers[object]; ok && compareSequencers(sequencer, last) <= 0 {
+		return false
+	}
+	vs.sequencers[object] = sequencer
+	return true
+}
+
+// compareSequencers orders two S3 event sequencers for the same object. They are hex numbers of varying length, so the
+// shorter one is padded with leading zeros before comparing.
+func compareSequencers(a string, b string) int {
+	a, b = strings.ToUpper(a), strings.ToUpper(b)
+	if len(a) < len(b) {
+		a = strings.Repeat("0", len(b)-len(a)) + a
+	} else if len(b) < len(a) {
+		b = strings.Repeat("0", len(a)-len(b)) + b
+	}
+	return strings.Compare(a, b)
+}
+
+// prepareVideo fills in the extra metadata for a video found outside of a full enumeration. Returns false if a
+// manifest is in use and doesn't list the video.
+func (vs *videoStorage) prepareVideo(video *Video) bool {
+	// sidecars are picked up by the next full enumeration, since an event doesn't say whether there is one
+	if vs.extras.enabled() {
+		vs.extras.forgetTag(video.Bucket, video.Key)
+		vs.extras.apply(vs.clients.forBucket(video.Bucket), video, "")
+	}
+	// with a manifest, only videos it lists belong in the library
+	if vs.manifest != nil {
+		entry, ok := vs.manifest.entry(video.Key)
+		if !ok {
+			return false
+		}
+		entry.apply(video)
+	}
+	if vs.prober != nil {
+		if probed, ok := vs.prober.Cached(video.ETag); ok {
+			video.applyProbe(probed)
+		}
+	}
+	return true
+}
+
+// addVideo adds a video to the library, or updates it if it is already there. Returns true if the library changed.
+func (vs *videoStorage) addVideo(video Video) bool {
+	vs.Lock()
+	defer vs.Unlock()
+
+	if vs.videos == nil {
+		vs.videos = &[]Video{}
+		vs.videoIndex = make(map[string]int)
+	}
+
+	if idx, ok := vs.videoIndex[video.Key]; ok {
+		// the same key in an earlier source takes priority
+		existing := (*vs.videos)[idx]
+		if existing.Bucket != video.Bucket && vs.sourceIndex(existing.Bucket, existing.Key) < vs.sourceIndex(video.Bucket, video.Key) {
+			return false
+		}
+
+		(*vs.videos)[idx] = video
+		log.WithField("video", video.Key).Info("video updated")
+		return true
+	}
+
+	*vs.videos = append(*vs.videos, video)
+	vs.videoIndex[video.Key] = len(*vs.videos) - 1
+	vs.videoCount = len(*vs.videos)
+	log.WithField("video", video.Key).Info("video added")
+	return true
+}
+
+// removeVideo drops a video from the library after it is deleted from `bucket`. If another source has its own copy of
+// the same key, that copy takes its place instead. Returns false if it wasn't there, or the library's copy is from a
+// different bucket.
+func (vs *videoStorage) removeVideo(bucket string, key string) bool {
+	vs.Lock()
+	idx, ok := vs.videoIndex[key]
+	ok = ok && (*vs.videos)[idx].Bucket == bucket
+	vs.Unlock()
+	if !ok {
+		return false
+	}
+
+	// look for another copy before taking the lock again, since it means going to S3
+	fallback, found, _ := vs.findVideo(key, bucket)
+	found = found && vs.prepareVideo(&fallback)
+
+	vs.Lock()
+	defer vs.Unlock()
+
+	idx, ok = vs.videoIndex[key]
+	if !ok || (*vs.videos)[idx].Bucket != bucket {
+		return false
+	}
+
+	delete(vs.invalid, key)
+	delete(vs.unprobed, key)
+
+	if found {
+		(*vs.videos)[idx] = fallback
+		log.WithFields(log.Fields{
+			"video":  key,
+			"bucket": fallback.Bucket,
+		}).Info("video removed, using the copy in another source")
+		return true
+	}
+
+	// move the last video in to the gap
+	videos := *vs.videos
+	last := len(videos) - 1
+	videos[idx] = videos[last]
+	vs.videoIndex[videos[idx].Key] = idx
+	*vs.videos = videos[:last]
+	delete(vs.videoIndex, key)
+	vs.videoCount = len(*vs.videos)
+
+	log.WithField("video", key).Info("video removed")
+	return true
+}
@@ -0,0 +1,206 @@
+package videostorage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeQueue is a stand-in for SQS that hands out the messages it is given once each and remembers which were deleted
+type fakeQueue struct {
+	sync.Mutex
+
+	pending []string
+	deleted []string
+}
+
+func (q *fakeQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		var messages strings.Builder
+		for i, body := range q.pending {
+			sum := md5.Sum([]byte(body))
+			var escaped strings.Builder
+			_ = xml.EscapeText(&escaped, []byte(body))
+			fmt.Fprintf(&messages, "<Message><MessageId>%d</MessageId><ReceiptHandle>receipt-%d</ReceiptHandle>"+
+				"<MD5OfBody>%s</MD5OfBody><Body>%s</Body></Message>", i, i, hex.EncodeToString(sum[:]), escaped.String())
+		}
+		q.pending = nil
+		fmt.Fprintf(w, "<ReceiveMessageResponse><ReceiveMessageResult>%s</ReceiveMessageResult>"+
+			"<ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></ReceiveMessageResponse>", messages.String())
+	case "DeleteMessage":
+		q.deleted = append(q.deleted, r.Form.Get("ReceiptHandle"))
+		fmt.Fprint(w, "<DeleteMessageResponse><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></DeleteMessageResponse>")
+	default:
+		http.Error(w, "unsupported action", http.StatusBadRequest)
+	}
+}
+
+// fakeBucket is a stand-in for S3 that only answers HEAD requests. It maps bucket/key to the object's ETag.
+type fakeBucket map[string]string
+
+func (b fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	etag, ok := b[strings.TrimPrefix(r.URL.Path, "/")]
+	if r.Method != http.MethodHead || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Content-Length", "100")
+	w.Header().Set("Last-Modified", "Mon, 02 Jan 2026 15:04:05 GMT")
+}
+
+func testSession(endpoint string) *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(endpoint),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+}
+
+// eventQueueTest sets up storage reading from the `primary` and `backup` buckets, with the S3 stand-in holding
+// `objects`, and returns a function that delivers messages through the SQS stand-in
+func eventQueueTest(t *testing.T, objects fakeBucket) (*videoStorage, func(messages ...string)) {
+	t.Helper()
+
+	bucket := httptest.NewServer(objects)
+	t.Cleanup(bucket.Close)
+	queue := &fakeQueue{}
+	queueServer := httptest.NewServer(queue)
+	t.Cleanup(queueServer.Close)
+
+	vs := &videoStorage{
+		sources: []Source{
+			NewSource("primary", "", nil, nil, 0),
+			NewSource("backup", "", nil, nil, 0),
+		},
+		clients:  newBucketClients(testSession(bucket.URL)),
+		plays:    make(map[string]*playRecord),
+		extras:   &extraMetadata{},
+		invalid:  make(map[string][]string),
+		unprobed: make(map[string]string),
+	}
+	client := sqs.New(testSession(queueServer.URL))
+	queueUrl := queueServer.URL + "/123456789012/events"
+
+	deliver := func(messages ...string) {
+		t.Helper()
+
+		queue.Lock()
+		queue.pending = messages
+		queue.Unlock()
+
+		if err := vs.pollEventQueue(client, queueUrl, 0); err != nil {
+			t.Fatalf("pollEventQueue() = %v", err)
+		}
+
+		queue.Lock()
+		defer queue.Unlock()
+		if len(queue.deleted) != len(messages) {
+			t.Fatalf("%d messages deleted, want %d", len(queue.deleted), len(messages))
+		}
+		queue.deleted = nil
+	}
+
+	return vs, deliver
+}
+
+// s3Event builds an S3 event notification for one object
+func s3Event(name string, bucket string, key string, sequencer string) string {
+	return fmt.Sprintf(`{"Records": [{"eventName": %q, "eventTime": "2026-01-02T15:04:05Z", "s3": {"bucket": {"name": %q},
+		"object": {"key": %q, "size": 100, "eTag": "etag-%s", "sequencer": %q}}}]}`, name, bucket, key, sequencer, sequencer)
+}
+
+func TestEventQueueIgnoresOutOfOrderEvents(t *testing.T) {
+	vs, deliver := eventQueueTest(t, fakeBucket{})
+
+	// the upload arrives after the deletion that followed it
+	deliver(
+		s3Event("ObjectCreated:Put", "primary", "a.flv", "0055AA"),
+		s3Event("ObjectRemoved:Delete", "primary", "a.flv", "0055AB"),
+		s3Event("ObjectCreated:Put", "primary", "a.flv", "0055A0"),
+	)
+	if vs.HasVideo("a.flv") {
+		t.Error("video was added back by an event older than its deletion")
+	}
+
+	// a shorter sequencer is padded, so 100 comes after FF
+	deliver(
+		s3Event("ObjectCreated:Put", "primary", "b.flv", "FF"),
+		s3Event("ObjectCreated:Put", "primary", "b.flv", "100"),
+		s3Event("ObjectCreated:Put", "primary", "b.flv", "FE"),
+	)
+	if video, ok := vs.GetVideoInfo("b.flv"); !ok || video.ETag != "etag-100" {
+		t.Errorf("b.flv has etag %q, want the one from the latest event", video.ETag)
+	}
+}
+
+func TestEventQueueFallsBackToAnotherSource(t *testing.T) {
+	vs, deliver := eventQueueTest(t, fakeBucket{"backup/a.flv": "backup-etag"})
+
+	deliver(
+		s3Event("ObjectCreated:Put", "primary", "a.flv", "01"),
+		s3Event("ObjectCreated:Put", "primary", "b.flv", "01"),
+	)
+	if vs.GetVideoCount() != 2 {
+		t.Fatalf("library has %d videos, want 2", vs.GetVideoCount())
+	}
+
+	deliver(
+		s3Event("ObjectRemoved:Delete", "primary", "a.flv", "02"),
+		s3Event("ObjectRemoved:Delete", "primary", "b.flv", "02"),
+	)
+
+	video, ok := vs.GetVideoInfo("a.flv")
+	if !ok {
+		t.Fatal("a.flv was removed even though the backup bucket has it")
+	}
+	if video.Bucket != "backup" || video.ETag != "backup-etag" {
+		t.Errorf("a.flv is from %s with etag %s, want the backup copy", video.Bucket, video.ETag)
+	}
+	if vs.HasVideo("b.flv") {
+		t.Error("b.flv is still in the library, but no source has it")
+	}
+	if vs.GetVideoCount() != 1 {
+		t.Errorf("library has %d videos, want 1", vs.GetVideoCount())
+	}
+}
+
+func TestCompareSequencers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"0055AFA1", "0055AFA1", 0},
+		{"0055AFA1", "0055AFA2", -1},
+		{"100", "FF", 1},
+		{"0FF", "ff", 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareSequencers(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareSequencers(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
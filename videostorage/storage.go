@@ -1,11 +1,97 @@
 package videostorage
 
-import "io"
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Video is everything known about a single video in storage
+type Video struct {
+	Key          string    `json:"key"`
+	Bucket       string    `json:"bucket"`
+	Title        string    `json:"title"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+
+	// these are only known once the video has been probed
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Width           int     `json:"width,omitempty"`
+	Height          int     `json:"height,omitempty"`
+	VideoCodec      string  `json:"video_codec,omitempty"`
+	AudioCodec      string  `json:"audio_codec,omitempty"`
+	BitRate         int64   `json:"bit_rate,omitempty"`
+
+	// these come from the manifest, if there is one
+	Weight   float64           `json:"weight,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	PlayCount  int        `json:"play_count"`
+	LastPlayed *time.Time `json:"last_played,omitempty"`
+}
+
+// Duration returns how long the video is, to the nearest second, or zero if that isn't known
+func (v Video) Duration() time.Duration {
+	return time.Duration(v.DurationSeconds * float64(time.Second)).Round(time.Second)
+}
+
+// EffectiveWeight is the video's weight, treating unset as 1
+func (v Video) EffectiveWeight() float64 {
+	if v.Weight <= 0 {
+		return 1
+	}
+	return v.Weight
+}
+
+// applyProbe fills in the details found by probing the video
+func (v *Video) applyProbe(res ProbeResult) {
+	v.DurationSeconds = res.DurationSeconds
+	v.Width = res.Width
+	v.Height = res.Height
+	v.VideoCodec = res.VideoCodec
+	v.AudioCodec = res.AudioCodec
+	v.BitRate = res.BitRate
+}
+
+// ErrNoVideos is returned by PickVideo when the library is empty, for example because the manifest doesn't list
+// anything or every video has been filtered out
+var ErrNoVideos = errors.New("no videos to pick from")
+
+// ErrAllQuarantined is returned by PickVideo when every video in the library failed validation and quarantine is on
+var ErrAllQuarantined = errors.New("every video failed validation")
 
 type Storage interface {
 	// PickVideo should return a random video from storage. This should return the name of the video as well
-	// as an `io.ReadCloser` to read the video
-	PickVideo() (string, io.ReadCloser)
+	// as an `io.ReadCloser` to read the video. Returns ErrNoVideos if there is nothing to pick from, or
+	// ErrAllQuarantined if everything there is failed validation.
+	PickVideo() (string, io.ReadCloser, error)
+	// ChooseVideo picks a random video for which `match` returns true, without opening it. Returns false if nothing
+	// matches.
+	ChooseVideo(match func(Video) bool) (Video, bool)
+	// OpenVideo opens the video with the given key. An error is returned if the key isn't a known video.
+	OpenVideo(key string) (io.ReadCloser, error)
+	// HasVideo reports whether the key is a known video
+	HasVideo(key string) bool
 	ForceEnumerate()
 	GetVideoCount() int
+	// ListVideos returns everything found by the last enumeration
+	ListVideos() []Video
+	// GetVideoInfo returns the details of a single video. Returns false if the key isn't a known video.
+	GetVideoInfo(key string) (Video, bool)
+	// RecordPlay notes that the video has just started playing
+	RecordPlay(key string)
+	// Validate checks every video against the ingest requirements, returning the ones that fail. Videos that fail are
+	// never picked, although they can still be opened directly.
+	Validate() []InvalidVideo
+	// InvalidVideos returns the videos that failed the last validation
+	InvalidVideos() []InvalidVideo
+}
+
+// Title turns a video's key in to something presentable by dropping the folders and extension
+func Title(key string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(path.Base(key), path.Ext(key)), "/")
 }
@@ -0,0 +1,121 @@
+package videostorage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Requirements describe what a video must look like to be streamed as is. The defaults follow Twitch's ingest
+// recommendations.
+type Requirements struct {
+	Formats                    []string
+	VideoCodecs                []string
+	AudioCodecs                []string
+	AudioSampleRates           []int
+	MaxBitRate                 int64
+	MaxKeyframeIntervalSeconds float64
+}
+
+// InvalidVideo is a video that failed validation, along with everything that is wrong with it
+type InvalidVideo struct {
+	Video
+	Problems []string `json:"problems"`
+}
+
+// RequirementsFromConfig reads the `validation` section of the config, falling back to the defaults for anything
+// that isn't set
+func RequirementsFromConfig() Requirements {
+	req := Requirements{
+		Formats:                    []string{"flv"},
+		VideoCodecs:                []string{"h264"},
+		AudioCodecs:                []string{"aac"},
+		AudioSampleRates:           []int{44100, 48000},
+		MaxBitRate:                 6500 * 1000,
+		MaxKeyframeIntervalSeconds: 4,
+	}
+
+	if formats := viper.GetStringSlice("validation.formats"); len(formats) > 0 {
+		req.Formats = formats
+	}
+	if codecs := viper.GetStringSlice("validation.video_codecs"); len(codecs) > 0 {
+		req.VideoCodecs = codecs
+	}
+	if codecs := viper.GetStringSlice("validation.audio_codecs"); len(codecs) > 0 {
+		req.AudioCodecs = codecs
+	}
+	if rates := viper.GetIntSlice("validation.audio_sample_rates"); len(rates) > 0 {
+		req.AudioSampleRates = rates
+	}
+	if bitRate := viper.GetInt64("validation.max_bit_rate_kbps"); bitRate != 0 {
+		req.MaxBitRate = bitRate * 1000
+	}
+	if interval := viper.GetFloat64("validation.max_keyframe_interval_seconds"); interval != 0 {
+		req.MaxKeyframeIntervalSeconds = interval
+	}
+
+	return req
+}
+
+// Check lists everything about a probed video that doesn't meet the requirements. An empty list means the video is
+// fine. Anything that couldn't be measured is given the benefit of the doubt.
+func (r Requirements) Check(res ProbeResult) []string {
+	var problems []string
+
+	if !containsFormat(r.Formats, res.FormatName) {
+		problems = append(problems, fmt.Sprintf("container is %s, expected %s", res.FormatName, strings.Join(r.Formats, " or ")))
+	}
+	if res.VideoCodec == "" {
+		problems = append(problems, "no video stream")
+	} else if !containsString(r.VideoCodecs, res.VideoCodec) {
+		problems = append(problems, fmt.Sprintf("video codec is %s, expected %s", res.VideoCodec, strings.Join(r.VideoCodecs, " or ")))
+	}
+	if res.AudioCodec == "" {
+		problems = append(problems, "no audio stream")
+	} else {
+		if !containsString(r.AudioCodecs, res.AudioCodec) {
+			problems = append(problems, fmt.Sprintf("audio codec is %s, expected %s", res.AudioCodec, strings.Join(r.AudioCodecs, " or ")))
+		}
+		if res.AudioSampleRate != 0 && !containsInt(r.AudioSampleRates, res.AudioSampleRate) {
+			problems = append(problems, fmt.Sprintf("audio sample rate is %d Hz", res.AudioSampleRate))
+		}
+	}
+	if r.MaxBitRate > 0 && res.BitRate > r.MaxBitRate {
+		problems = append(problems, fmt.Sprintf("bit rate is %d kbps, limit is %d kbps", res.BitRate/1000, r.MaxBitRate/1000))
+	}
+	if r.MaxKeyframeIntervalSeconds > 0 && res.KeyframeIntervalSeconds > r.MaxKeyframeIntervalSeconds {
+		problems = append(problems, fmt.Sprintf("keyframe interval is %.1fs, limit is %.1fs", res.KeyframeIntervalSeconds, r.MaxKeyframeIntervalSeconds))
+	}
+
+	return problems
+}
+
+// containsFormat checks ffprobe's format name, which can be a comma separated list of aliases, against the allowed
+// formats
+func containsFormat(allowed []string, formatName string) bool {
+	for _, curr := range strings.Split(formatName, ",") {
+		if containsString(allowed, curr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, curr := range list {
+		if strings.EqualFold(curr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, curr := range list {
+		if curr == n {
+			return true
+		}
+	}
+	return false
+}